@@ -0,0 +1,103 @@
+package alwayscache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/always-cache/always-cache/cache"
+	"github.com/always-cache/always-cache/rfc9111"
+)
+
+// Minimum number of recorded bodies before the refresh interval of an entry is adapted.
+const minAdaptiveChecks = 3
+
+// AdaptiveTTL configures adapting the refresh interval of entries
+// to how often their body actually changes.
+type AdaptiveTTL struct {
+	// Adapt refresh intervals of entries.
+	Enabled bool
+	// Minimum refresh interval as a fraction of the lifetime declared by the origin.
+	// Defaults to 0.1.
+	MinFactor float64
+	// Maximum refresh interval as a fraction of the lifetime declared by the origin.
+	// Defaults to 1. Values above 1 only take effect if Override is set.
+	MaxFactor float64
+	// Serve entries whose body rarely changes beyond the lifetime declared by the origin,
+	// up to MaxFactor times the lifetime. Clients requiring validation are not affected.
+	Override bool
+}
+
+// recordBody records the hash of the stored body, returning the change history of the entry.
+func (a *AlwaysCache) recordBody(key string, body []byte) (cache.ChangeHistory, error) {
+	hash := sha256.Sum256(body)
+	return a.cache.RecordBody(key, hex.EncodeToString(hash[:]))
+}
+
+// adaptiveExpiry returns the time by which the entry should be refreshed,
+// based on how often its body has changed relative to the lifetime declared by the origin.
+// The expiry of the entry is returned as is if adaptive TTL is disabled or not applicable.
+func (a *AlwaysCache) adaptiveExpiry(ce cache.CacheEntry, res *http.Response, h cache.ChangeHistory) time.Time {
+	ttl := ce.Expires.Sub(ce.ReceivedAt)
+	if !a.adaptive.Enabled || ce.Expires.IsZero() || ttl <= 0 ||
+		h.Checks < minAdaptiveChecks || len(h.ChangedAt) == 0 || requiresRevalidation(res) {
+		return ce.Expires
+	}
+	factor := float64(changeInterval(h, ce.ReceivedAt)) / float64(ttl)
+	maxFactor := a.adaptive.MaxFactor
+	if !a.adaptive.Override && maxFactor > 1 {
+		maxFactor = 1
+	}
+	if factor < a.adaptive.MinFactor {
+		factor = a.adaptive.MinFactor
+	} else if factor > maxFactor {
+		factor = maxFactor
+	}
+	a.log.Trace().
+		Str("key", ce.Key).
+		Float64("factor", factor).
+		Int64("changes", h.Changes).
+		Int64("checks", h.Checks).
+		Msg("Adapting refresh interval")
+	return ce.ReceivedAt.Add(time.Duration(float64(ttl) * factor))
+}
+
+// mayServeExtended checks if the stored entry may be served beyond the lifetime declared by the origin,
+// which is the case when its expiry has been extended past that lifetime by the adaptive TTL override,
+// and neither the origin nor the client asks for validation.
+func (a *AlwaysCache) mayServeExtended(r *http.Request, res *http.Response, ce cache.CacheEntry) bool {
+	if !a.adaptive.Enabled || !a.adaptive.Override || !time.Now().Before(ce.Expires) ||
+		r.Header.Get("Cache-Control") != "" || r.Header.Get("Pragma") != "" {
+		return false
+	}
+	extended := ce.Expires.After(ce.ReceivedAt.Add(rfc9111.FreshnessLifetime(res)))
+	return extended && !requiresRevalidation(res)
+}
+
+// changeInterval estimates how long the body of an entry stays unchanged.
+// The estimate is the mean interval between the recorded changes,
+// or the time since the latest change if it is longer.
+// If the body changed every time it was checked, it probably changes more often than that,
+// so the estimate is halved.
+func changeInterval(h cache.ChangeHistory, now time.Time) time.Duration {
+	n := len(h.ChangedAt)
+	last := h.ChangedAt[n-1]
+	interval := now.Sub(last)
+	if n > 1 {
+		if mean := last.Sub(h.ChangedAt[0]) / time.Duration(n-1); mean > interval {
+			interval = mean
+		}
+	}
+	if h.Changes >= h.Checks {
+		interval /= 2
+	}
+	return interval
+}
+
+// requiresRevalidation checks if the origin explicitly requires the response to be revalidated,
+// in which case its lifetime is never adapted.
+func requiresRevalidation(res *http.Response) bool {
+	cc := rfc9111.ParseCacheControl(res.Header.Values("Cache-Control"))
+	return cc.HasDirective("no-cache") || cc.HasDirective("must-revalidate") || cc.HasDirective("proxy-revalidate")
+}
@@ -0,0 +1,63 @@
+package alwayscache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/always-cache/always-cache/cache"
+)
+
+func TestAdaptiveExpiry(t *testing.T) {
+	now := time.Now()
+	ce := cache.CacheEntry{Key: "key", ReceivedAt: now, Expires: now.Add(time.Hour)}
+	res := &http.Response{Header: http.Header{"Cache-Control": {"max-age=3600"}}}
+	a := AlwaysCache{adaptive: AdaptiveTTL{Enabled: true, MinFactor: 0.1, MaxFactor: 4}}
+
+	// unchanged for a day: at most the origin lifetime without override
+	stable := cache.ChangeHistory{Checks: 24, Changes: 1, ChangedAt: []time.Time{now.Add(-24 * time.Hour)}}
+	if exp := a.adaptiveExpiry(ce, res, stable); !exp.Equal(ce.Expires) {
+		t.Fatalf("Expiry is %s, expected origin expiry", exp.Sub(now))
+	}
+	a.adaptive.Override = true
+	if exp := a.adaptiveExpiry(ce, res, stable); !exp.Equal(now.Add(4 * time.Hour)) {
+		t.Fatalf("Expiry is %s, expected 4h with override", exp.Sub(now))
+	}
+
+	// changed on every check: shorter than the origin lifetime, within bounds
+	changing := cache.ChangeHistory{Checks: 3, Changes: 3, ChangedAt: []time.Time{now.Add(-2 * time.Hour), now.Add(-time.Hour), now}}
+	if exp := a.adaptiveExpiry(ce, res, changing); !exp.Equal(now.Add(30 * time.Minute)) {
+		t.Fatalf("Expiry is %s, expected 30m", exp.Sub(now))
+	}
+	changing.ChangedAt = []time.Time{now.Add(-2 * time.Minute), now.Add(-time.Minute), now}
+	if exp := a.adaptiveExpiry(ce, res, changing); !exp.Equal(now.Add(6 * time.Minute)) {
+		t.Fatalf("Expiry is %s, expected minimum of 6m", exp.Sub(now))
+	}
+
+	// never adapted if the origin requires revalidation
+	res.Header.Set("Cache-Control", "max-age=3600, must-revalidate")
+	if exp := a.adaptiveExpiry(ce, res, stable); !exp.Equal(ce.Expires) {
+		t.Fatalf("Expiry is %s, expected origin expiry", exp.Sub(now))
+	}
+}
+
+func TestMayServeExtended(t *testing.T) {
+	now := time.Now()
+	req, _ := http.NewRequest("GET", "/", nil)
+	res := &http.Response{Header: http.Header{"Cache-Control": {"max-age=3600"}}}
+	a := AlwaysCache{adaptive: AdaptiveTTL{Enabled: true, Override: true, MinFactor: 0.1, MaxFactor: 4}}
+
+	extended := cache.CacheEntry{ReceivedAt: now.Add(-2 * time.Hour), Expires: now.Add(time.Hour)}
+	if !a.mayServeExtended(req, res, extended) {
+		t.Fatalf("Extended entry may not be served")
+	}
+	// stale entries which were not extended are validated as usual
+	notExtended := cache.CacheEntry{ReceivedAt: now.Add(-2 * time.Hour), Expires: now.Add(-time.Hour)}
+	if a.mayServeExtended(req, res, notExtended) {
+		t.Fatalf("Entry which was not extended may be served")
+	}
+	res.Header.Set("Cache-Control", "max-age=3600, no-cache")
+	if a.mayServeExtended(req, res, extended) {
+		t.Fatalf("Entry requiring revalidation may be served")
+	}
+}
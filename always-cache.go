@@ -3,18 +3,26 @@ package alwayscache
 import (
 	"bufio"
 	"bytes"
-	"crypto/tls"
 	"io"
+	"io/fs"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/always-cache/always-cache/cache"
 	cachekey "github.com/always-cache/always-cache/pkg/cache-key"
+	"github.com/always-cache/always-cache/pkg/fastcgi"
+	budget "github.com/always-cache/always-cache/pkg/origin-budget"
+	pool "github.com/always-cache/always-cache/pkg/origin-pool"
 	serializer "github.com/always-cache/always-cache/pkg/response-serializer"
 	tee "github.com/always-cache/always-cache/pkg/response-writer-tee"
+	static "github.com/always-cache/always-cache/pkg/static-origin"
+	scheduler "github.com/always-cache/always-cache/pkg/update-scheduler"
 	"github.com/always-cache/always-cache/rfc9111"
 	"github.com/always-cache/always-cache/rfc9211"
 
@@ -25,8 +33,40 @@ type Config struct {
 	// Storage for cache entries.
 	Cache cache.CacheProvider
 	// URL of the origin server.
-	// Origins with paths are not supparted.
+	// The path of the URL, if any, is prepended to the paths of requests forwarded to the origin.
+	// An HTTP server listening on a Unix socket is given as `unix:///path/to/app.sock`.
 	OriginURL url.URL
+	// Handler serving as the origin, called in-process instead of sending requests over the network.
+	// The origin URL is optional. The `Host` header is OriginHost or the host of the origin URL if set,
+	// otherwise the one of the client request (or `localhost` for requests made by the cache itself).
+	OriginHandler http.Handler
+	// Mapping of requests to scripts for FastCGI origins, i.e. origin URLs like `fcgi://127.0.0.1:9000`
+	// or `fcgi+unix:///run/php/php-fpm.sock`.
+	FastCGI fastcgi.Config
+	// File system serving as the origin, e.g. a local build directory, instead of an origin server.
+	// It is set automatically for `file://` origin URLs.
+	OriginFS fs.FS
+	// Cache-Control header of the responses of the origin file system. Defaults to `max-age=60`.
+	OriginFSCacheControl string
+	// How often the origin file system is checked for changes, which update the affected URLs.
+	// Each check walks the whole file system, so large trees need a longer interval.
+	// Zero disables checking for changes.
+	OriginFSWatchInterval time.Duration
+	// Prefix removed from the paths of requests before forwarding them to the origin,
+	// e.g. `/api` when the origin expects paths without it.
+	StripPrefix string
+	// Identifier of the origin in cache keys. Defaults to the origin URL.
+	// Origins sharing the same cache must have distinct identifiers.
+	OriginId string
+	// Limits for fetches initiated by the cache itself (updates, warming, schedules),
+	// in order to protect the origin. Client-driven fetches are never delayed.
+	// The zero value means no limits.
+	OriginBudget budget.Config
+	// Servers serving the origin, used instead of the host of the origin URL.
+	// Requests are balanced between the healthy servers and fail over to other servers.
+	OriginPool pool.Config
+	// Timeouts, connection pooling and TLS settings of the connections to the origin.
+	OriginTransport OriginTransport
 	// Hostname to use for HTTP requests and TLS negotiation.
 	// Use if needed if e.g. the origin URL is just an IP address.
 	OriginHost string
@@ -40,15 +80,71 @@ type Config struct {
 	ResponseModifier func(*http.Response) error
 	// Disable automatic updates of expiring content, i.e. legacy mode.
 	DisableUpdates bool
+	// Number of concurrent workers updating expiring content. Defaults to 4.
+	UpdateWorkers int
+	// Fraction of the content lifetime after which it is updated. Defaults to 0.9.
+	RefreshAhead float64
+	// Maximum random fraction of the content lifetime to update earlier than RefreshAhead,
+	// in order to spread out updates of content stored at the same time. Defaults to 0.05.
+	RefreshJitter float64
+	// Maximum time a stored response is served stale when updating it fails transiently.
+	// After this, the response is purged. Zero means stale responses are not served.
+	MaxStaleness time.Duration
+	// Maximum depth of transitive updates of responses declaring dependencies with `Cache-Depends`.
+	// Defaults to 5.
+	MaxDependencyDepth int
+	// Do not update expiring entries that have not been requested within this duration.
+	// Zero means that all entries are updated regardless of use.
+	IdleTimeout time.Duration
+	// Additional time before entries that have never been requested (e.g. warmed entries)
+	// are considered idle.
+	IdleGracePeriod time.Duration
+	// Purge idle entries instead of leaving them to expire.
+	PurgeIdle bool
+	// Path of the endpoint for pushing responses into the cache, e.g. `/.always-cache/push`.
+	// Requests to the path are not proxied. The endpoint is enabled only if PushToken is set.
+	PushPath string
+	// Bearer token required for pushing responses.
+	PushToken string
+	// Paths of GraphQL endpoints, e.g. `/graphql`. Queries to them are cached based on the
+	// normalized operation, mutations and subscriptions are never cached.
+	// Mutations update the stored queries touching the modified types.
+	GraphQLPaths []string
+	// Adapt the refresh interval of entries to how often their body actually changes.
+	AdaptiveTTL AdaptiveTTL
+	// Serve stored responses regardless of freshness while the origin is unavailable.
+	Offline OfflineMode
+	// Groups of URIs to refresh at fixed times, independent of expiry.
+	Schedules []RefreshSchedule
+	// Maximum number of concurrent fetches per schedule run. Defaults to 2.
+	ScheduleConcurrency int
 }
 
 type AlwaysCache struct {
 	cache          cache.CacheProvider
 	keyer          cachekey.CacheKeyer
 	log            zerolog.Logger
-	updateTimeout  time.Duration
+	updater        *scheduler.Scheduler
+	jobs           *scheduler.Scheduler
 	reverseproxy   httputil.ReverseProxy
+	budget         *budget.Budget
+	pool           *pool.Pool
 	modifyResponse func(*http.Request)
+	idle           idlePolicy
+	adaptive       AdaptiveTTL
+	pushPath       string
+	pushToken      string
+	graphQLPaths   []string
+	retries        *retryState
+	offline        *offlineState
+	maxStaleness   time.Duration
+	maxDepsDepth   int
+	// concurrency of refresh schedule runs
+	scheduleConcurrency int
+	scheduleRuns        *scheduleRuns
+	// closed on Close to stop the background processes
+	done      chan struct{}
+	closeOnce *sync.Once
 }
 
 // CreateCache initializes the always-cache instance.
@@ -68,42 +164,183 @@ func CreateCache(config Config) *AlwaysCache {
 		Str("origin", config.OriginURL.String()).
 		Logger()
 
+	originId := config.OriginId
+	if originId == "" {
+		originId = config.OriginURL.String()
+	}
+	if originId == "" && config.OriginFS != nil {
+		originId = "fs"
+	} else if originId == "" && config.OriginHandler != nil {
+		originId = "handler"
+	}
+
 	a := &AlwaysCache{
 		cache:          config.Cache,
-		keyer:          cachekey.NewCacheKeyer(config.OriginURL.String()),
+		keyer:          cachekey.NewCacheKeyer(originId),
 		log:            logger,
 		modifyResponse: config.RequestModifier,
+		retries:        newRetryState(),
+		offline:        newOfflineState(config.Offline),
+		maxStaleness:   config.MaxStaleness,
+		pushPath:       config.PushPath,
+		pushToken:      config.PushToken,
+		graphQLPaths:   config.GraphQLPaths,
+		done:           make(chan struct{}),
+		closeOnce:      &sync.Once{},
+		idle: idlePolicy{
+			timeout: config.IdleTimeout,
+			grace:   config.IdleGracePeriod,
+			purge:   config.PurgeIdle,
+			skipped: &atomic.Int64{},
+		},
 	}
 
 	host := config.OriginURL.Host
 	hostHeader := host
-	transport := http.DefaultTransport
 	if config.OriginHost != "" {
 		hostHeader = config.OriginHost
-		transport = &http.Transport{
-			TLSClientConfig: &tls.Config{
-				ServerName: config.OriginHost,
-			},
+	}
+	var transport http.RoundTripper = config.OriginTransport.transport(config.OriginHost)
+
+	if len(config.OriginPool.Addresses) > 0 && !overHTTP(config) {
+		a.log.Error().Str("origin", config.OriginURL.String()).Msg("Origin pool can only be used with http and https origins, ignoring")
+	} else if len(config.OriginPool.Addresses) > 0 {
+		// the pool members are addressed directly, so TLS is negotiated for the origin host
+		transport = config.OriginTransport.transport(hostname(hostHeader))
+		poolConfig := config.OriginPool
+		if poolConfig.HealthHost == "" {
+			poolConfig.HealthHost = hostHeader
 		}
+		poolConfig.OnChange = a.logPoolChange
+		a.pool = pool.New(poolConfig, transport)
+		transport = a.pool
+	}
+
+	origin := config.OriginURL
+	switch origin.Scheme {
+	case "file":
+		config.OriginFS = os.DirFS(origin.Path)
+	case "fcgi", "fcgi+unix":
+		if config.FastCGI.DocumentRoot == "" {
+			a.log.Error().Msg("No document root for the FastCGI origin, scripts will not be found")
+		}
+		if config.FastCGI.Stderr == nil {
+			config.FastCGI.Stderr = func(message string) {
+				a.log.Warn().Str("stderr", message).Msg("FastCGI origin reported errors")
+			}
+		}
+		if origin.Scheme == "fcgi" {
+			transport = fastcgi.New("tcp", origin.Host, config.FastCGI)
+		} else {
+			transport = fastcgi.New("unix", origin.Path, config.FastCGI)
+		}
+		// the FastCGI server is not addressed by host, the client host is passed on unless configured
+		origin = url.URL{Scheme: "http", Host: origin.Host}
+		hostHeader = config.OriginHost
+	case "unix":
+		transport = config.OriginTransport.unixTransport(origin.Path)
+		// like FastCGI, the client host is passed on unless configured
+		origin = url.URL{Scheme: "http", Host: "localhost"}
+		hostHeader = config.OriginHost
+	}
+	if config.OriginFS != nil {
+		config.OriginHandler = static.New(config.OriginFS, config.OriginFSCacheControl)
+		if config.OriginFSWatchInterval > 0 {
+			go static.Watch(config.OriginFS, config.OriginFSWatchInterval, a.updateFiles, a.done)
+		}
+	}
+	if config.OriginHandler != nil {
+		// the origin is called in-process, the origin URL only identifies the origin
+		origin = url.URL{Scheme: "http", Host: origin.Host}
+		transport = handlerTransport{config.OriginHandler}
 	}
 
 	a.reverseproxy = httputil.ReverseProxy{
-		Director:       createDirector(config.OriginURL.Scheme, host, hostHeader),
+		Director:       createDirector(origin, hostHeader, config.StripPrefix),
 		Transport:      transport,
 		ModifyResponse: config.ResponseModifier,
 	}
 
-	// start a goroutine to update expired entries
-	if !config.DisableUpdates {
-		a.updateTimeout = time.Second
+	a.budget = budget.New(config.OriginBudget)
+
+	a.adaptive = config.AdaptiveTTL
+	if a.adaptive.MinFactor == 0 {
+		a.adaptive.MinFactor = 0.1
+	}
+	if a.adaptive.MaxFactor == 0 {
+		a.adaptive.MaxFactor = 1
+	}
+
+	a.maxDepsDepth = config.MaxDependencyDepth
+	if a.maxDepsDepth == 0 {
+		a.maxDepsDepth = 5
 	}
-	if a.updateTimeout != 0 {
-		go a.updateCache()
+
+	a.scheduleConcurrency = config.ScheduleConcurrency
+	if a.scheduleConcurrency == 0 {
+		a.scheduleConcurrency = 2
 	}
+	a.scheduleRuns = &scheduleRuns{}
+	a.startSchedules(config.Schedules)
+
+	// delayed updates are run regardless of the update mode
+	a.jobs = scheduler.New(1, 1, 0, a.runJob)
+	go a.restoreJobs()
+
+	// start workers to update expiring entries
+	if !config.DisableUpdates {
+		workers := config.UpdateWorkers
+		if workers == 0 {
+			workers = 4
+		}
+		ahead := config.RefreshAhead
+		if ahead == 0 {
+			ahead = 0.9
+		}
+		jitter := config.RefreshJitter
+		if jitter == 0 {
+			jitter = 0.05
+		}
+		a.updater = scheduler.New(workers, ahead, jitter, a.updateScheduled)
+		go a.startUpdates()
+	}
+	go a.logStats()
 
 	return a
 }
 
+// overHTTP checks if the origin is reached over HTTP, rather than FastCGI, a Unix socket or in-process.
+func overHTTP(config Config) bool {
+	scheme := config.OriginURL.Scheme
+	return (scheme == "http" || scheme == "https") && config.OriginHandler == nil && config.OriginFS == nil
+}
+
+// Close stops the background processes of the instance and closes the cache storage.
+// Running updates are finished first. Requests cannot be served after closing,
+// so close the instance after shutting down the server.
+func (a *AlwaysCache) Close() {
+	a.stop()
+	if err := a.cache.Close(); err != nil {
+		a.log.Error().Err(err).Msg("Could not close cache")
+	}
+}
+
+// stop stops the background processes of the instance, i.e. the update workers,
+// delayed updates, refresh schedules, file watching, origin probes and health checks,
+// and the periodic logging of stats. The cache storage is left open.
+func (a *AlwaysCache) stop() {
+	a.closeOnce.Do(func() {
+		close(a.done)
+		if a.updater != nil {
+			a.updater.Stop()
+		}
+		a.jobs.Stop()
+		if a.pool != nil {
+			a.pool.Close()
+		}
+	})
+}
+
 type request struct {
 	r           *http.Request
 	cacheStatus rfc9211.CacheStatus
@@ -112,10 +349,21 @@ type request struct {
 
 // ServeHTTP implements the http.Handler interface.
 func (a *AlwaysCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if a.modifyResponse != nil {
-		a.modifyResponse(r)
+	if a.pushPath != "" && a.pushToken != "" && r.URL.Path == a.pushPath {
+		a.servePush(w, r)
+		return
+	}
+	var cacheable bool
+	if r, cacheable = a.prepareRequest(r); !cacheable {
+		a.proxy(w, r)
+		return
 	}
-	for _, ce := range a.getResponsesForUri(r) {
+	entries := a.getResponsesForUri(r)
+	if a.offline.active() {
+		a.serveOffline(w, r, entries)
+		return
+	}
+	for _, ce := range entries {
 		if a.reuseOrValidate(w, r, ce) == "" {
 			return
 		}
@@ -123,21 +371,50 @@ func (a *AlwaysCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	a.proxy(w, r)
 }
 
+// prepareRequest prepares a request for looking up and storing its responses: the request modifier
+// is applied, and the body of POST requests is buffered (and GraphQL requests normalized),
+// so that the cache key can include it. It returns false if responses to the request are not cached.
+func (a *AlwaysCache) prepareRequest(r *http.Request) (*http.Request, bool) {
+	if a.modifyResponse != nil {
+		a.modifyResponse(r)
+	}
+	if r.Method == http.MethodPost {
+		bufferBody(r)
+		if hasUnbufferedBody(r) {
+			return r, false
+		}
+	}
+	if a.isGraphQL(r) {
+		return a.prepareGraphQL(r)
+	}
+	return r, true
+}
+
 func (a *AlwaysCache) reuseOrValidate(w http.ResponseWriter, r *http.Request, ce cache.CacheEntry) rfc9211.FwdReason {
 	res := a.createStoredResponse(ce)
+	stale := false
 	if fwdReason, validationReq, err := rfc9111.MustNotReuse(r, res, ce.RequestedAt, ce.ReceivedAt); err != nil {
 		a.log.Error().Err(err).Msg("Could not determine reusability")
 		return rfc9211.FwdReasonMiss
 	} else if validationReq != nil {
-		if a.sendToClientIfValidationFailed(w, r, validationReq) {
+		// the entry is the one for this request, whether it is reused or replaced
+		a.cache.RecordAccess(ce.Key)
+		var sent bool
+		if a.mayServeExtended(r, res, ce) {
+			stale = true
+		} else if sent, stale = a.sendToClientIfValidationFailed(w, r, validationReq, a.mayServeStale(ce)); sent {
 			return ""
 		}
 	} else if fwdReason != "" {
 		return fwdReason
 	}
 	// if we get here, the response is ok to use
+	a.cache.RecordHit(ce.Key)
 	cs := rfc9211.CacheStatus{}
 	cs.Hit()
+	if stale {
+		cs.Detail = "stale"
+	}
 	a.sendStoredResponse(w, r, res, ce, cs)
 	return cs.FwdReason
 }
@@ -158,16 +435,39 @@ func (a *AlwaysCache) sendStoredResponse(w http.ResponseWriter, r *http.Request,
 	a.log.Trace().Msgf("Wrote body (%d bytes)", bytesWritten)
 }
 
-func (a *AlwaysCache) sendToClientIfValidationFailed(w http.ResponseWriter, clientRequest, validationReq *http.Request) bool {
-	rwtee := tee.NewResponseSaver(w, http.StatusNotModified)
-	a.reverseproxy.ServeHTTP(rwtee, validationReq)
+// sendToClientIfValidationFailed sends the validation request to the origin.
+// It returns true if the origin response was sent to the client.
+// If serveStale is true, transient origin failures are not sent to the client.
+// Instead, the second return value is true, meaning the stale stored response should be used.
+func (a *AlwaysCache) sendToClientIfValidationFailed(w http.ResponseWriter, clientRequest, validationReq *http.Request, serveStale bool) (bool, bool) {
+	filters := []int{http.StatusNotModified}
+	if serveStale {
+		filters = append(filters, transientFailureStatusCodes...)
+	}
+	rwtee := tee.NewResponseSaver(w, filters...)
+	// the validation request is made on behalf of the client
+	validationReq.RemoteAddr = clientRequest.RemoteAddr
+	a.forward(rwtee, validationReq)
+	if serveStale && isTransientFailure(rwtee.StatusCode()) {
+		a.log.Warn().
+			Str("url", clientRequest.URL.String()).
+			Int("status", rwtee.StatusCode()).
+			Msg("Validation failed, serving stale response")
+		return false, true
+	}
 	// all status codes other than 304 means the response was written to the client
 	// the response will need to be saved as well
 	if rwtee.StatusCode() != http.StatusNotModified {
 		go a.updateResposeAndLocations(rwtee, clientRequest)
-		return true
+		return true, false
 	}
-	return false
+	return false, false
+}
+
+// mayServeStale checks if the stored entry may be served stale, which is the case
+// when updating it has failed and it has not been stale for longer than allowed.
+func (a *AlwaysCache) mayServeStale(ce cache.CacheEntry) bool {
+	return a.retries.failing(ce.Key) && time.Since(ce.Expires) < a.maxStaleness
 }
 
 func (a *AlwaysCache) createStoredResponse(ce cache.CacheEntry) *http.Response {
@@ -184,6 +484,16 @@ func (a *AlwaysCache) createStoredResponse(ce cache.CacheEntry) *http.Response {
 	return res
 }
 
+// storedBody returns the body of the stored response bytes.
+func storedBody(b []byte) ([]byte, error) {
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b)), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return io.ReadAll(res.Body)
+}
+
 func (a *AlwaysCache) getResponsesForUri(r *http.Request) []cache.CacheEntry {
 	keyUriPrefix := a.keyer.GetKeyPrefix(r)
 	a.log.Trace().Str("key", keyUriPrefix).Msg("Getting cached entries")
@@ -197,7 +507,11 @@ func (a *AlwaysCache) getResponsesForUri(r *http.Request) []cache.CacheEntry {
 }
 
 func (a *AlwaysCache) updateResposeAndLocations(rw *tee.ResponseSaver, r *http.Request) {
-	a.writeCache(rw, r)
+	if stored, _ := a.writeCache(rw, r); stored {
+		// the response was requested by a client, unlike those stored by updates
+		a.cache.RecordAccess(a.responseKey(r, rw.Header()))
+	}
+	a.updateGraphQLTypes(r, rw)
 	a.updateIfNeeded(r, &http.Response{
 		StatusCode: rw.StatusCode(),
 		Header:     rw.Header(),
@@ -206,6 +520,10 @@ func (a *AlwaysCache) updateResposeAndLocations(rw *tee.ResponseSaver, r *http.R
 }
 
 func (a *AlwaysCache) proxy(w http.ResponseWriter, r *http.Request) {
+	if a.offline.active() {
+		a.sendMaintenancePage(w, r)
+		return
+	}
 	a.log.Trace().Msgf("proxying %s", r.URL.String())
 	// set cache-status on underlying rw only (i.e. do not save to cache)
 	cs := rfc9211.CacheStatus{}
@@ -213,7 +531,7 @@ func (a *AlwaysCache) proxy(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Cache-Status", cs.String())
 
 	rwtee := tee.NewResponseSaver(w)
-	a.reverseproxy.ServeHTTP(rwtee, r)
+	a.forward(rwtee, r)
 
 	// log request
 	go a.logRequest(r, cs)
@@ -246,13 +564,14 @@ func (a *AlwaysCache) writeCache(rw *tee.ResponseSaver, r *http.Request) (bool,
 	}
 	if noStore, err := rfc9111.MustNotStore(res); err != nil {
 		return false, err
-	} else if noStore {
+	} else if noStore || hasUnbufferedBody(r) || mustNotStoreGraphQL(r) {
 		return false, nil
 	}
-	keyPrefix := a.keyer.GetKeyPrefix(r)
-	key := a.keyer.AddVaryKeys(keyPrefix, r, &http.Response{
-		Header: rw.Header(),
-	})
+	// in offline mode, an unavailable origin must not replace stored responses with its failures
+	if a.offline.enabled() && originUnavailable(rw.StatusCode()) {
+		return false, nil
+	}
+	key := a.responseKey(r, rw.Header())
 	exp := rfc9111.GetExpiration(res)
 	ce := cache.CacheEntry{
 		Key:         key,
@@ -261,19 +580,64 @@ func (a *AlwaysCache) writeCache(rw *tee.ResponseSaver, r *http.Request) (bool,
 		ReceivedAt:  time.Now(),
 		Bytes:       rw.Response(),
 	}
-	a.log.Trace().Msgf("Writing to cache: %v %v", key, exp)
-	err := a.cache.PutCE(ce)
-	return err == nil, err
+	// the entry is refreshed by the adaptive expiry, but only stored as such if it extends the lifetime
+	refresh := ce
+	body, err := storedBody(ce.Bytes)
+	if err != nil {
+		return false, err
+	}
+	if history, err := a.recordBody(key, body); err != nil {
+		a.log.Error().Err(err).Str("key", key).Msg("Could not record body")
+	} else {
+		refresh.Expires = a.adaptiveExpiry(ce, res, history)
+		if refresh.Expires.After(ce.Expires) {
+			ce.Expires = refresh.Expires
+		}
+	}
+	a.log.Trace().Msgf("Writing to cache: %v %v", key, ce.Expires)
+	if err := a.cache.PutCE(ce); err != nil {
+		return false, err
+	}
+	a.cache.RecordUpdate(key, ce.ReceivedAt.Sub(ce.RequestedAt))
+	a.storeRequest(key, r, res)
+	a.storeDependencies(key, r, res, body)
+	a.scheduleUpdate(refresh)
+	return true, nil
+}
+
+// responseKey returns the key under which the response with the given header is stored for the request.
+func (a *AlwaysCache) responseKey(r *http.Request, header http.Header) string {
+	return a.keyer.AddVaryKeys(a.keyer.GetKeyPrefix(r), r, &http.Response{Header: header})
+}
+
+// Stats returns the access statistics of all entries stored for this origin.
+func (a *AlwaysCache) Stats() ([]cache.EntryStats, error) {
+	return a.cache.Stats(a.keyer.OriginPrefix)
 }
 
-func createDirector(scheme, host, hostHeader string) func(req *http.Request) {
+func createDirector(origin url.URL, hostHeader, stripPrefix string) func(req *http.Request) {
+	basePath, baseRawPath := origin.Path, origin.EscapedPath()
 	return func(req *http.Request) {
-		req.URL.Scheme = scheme
-		req.URL.Host = host
+		req.URL.Scheme = origin.Scheme
+		req.URL.Host = origin.Host
 		if hostHeader != "" {
 			req.Host = hostHeader
 		}
+		if basePath != "" || stripPrefix != "" {
+			if req.URL.RawPath != "" {
+				req.URL.RawPath = joinPath(baseRawPath, strings.TrimPrefix(req.URL.RawPath, stripPrefix))
+			}
+			req.URL.Path = joinPath(basePath, strings.TrimPrefix(req.URL.Path, stripPrefix))
+		}
+	}
+}
+
+// joinPath appends the request path to the base path of the origin.
+func joinPath(base, path string) string {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
 	}
+	return strings.TrimSuffix(base, "/") + path
 }
 
 func (a *AlwaysCache) getResponses(r *http.Request) ([]serializer.TimedResponse, error) {
@@ -4,14 +4,21 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/fcgi"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/always-cache/always-cache/cache"
+	"github.com/always-cache/always-cache/pkg/fastcgi"
+	pool "github.com/always-cache/always-cache/pkg/origin-pool"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -22,6 +29,12 @@ func init() {
 }
 
 func startTestServer(handler *http.ServeMux, port int) (AlwaysCache, *http.Server) {
+	return startTestServerWithConfig(handler, port, Config{})
+}
+
+// startTestServerWithConfig starts an origin server and an always-cache instance for it.
+// The cache provider and origin URL are set automatically.
+func startTestServerWithConfig(handler *http.ServeMux, port int, config Config) (AlwaysCache, *http.Server) {
 	// start server
 	server := http.Server{
 		Addr:    fmt.Sprintf(":%d", port),
@@ -35,10 +48,9 @@ func startTestServer(handler *http.ServeMux, port int) (AlwaysCache, *http.Serve
 	}()
 	// start set up acache
 	url, _ := url.Parse(fmt.Sprintf("http://localhost:%d", port))
-	acache := CreateCache(Config{
-		Cache:     cache.NewSQLiteCache(""),
-		OriginURL: *url,
-	})
+	config.Cache = cache.NewSQLiteCache("")
+	config.OriginURL = *url
+	acache := CreateCache(config)
 	// wait a small while to ensure server is up
 	time.Sleep(time.Millisecond * 200)
 
@@ -76,14 +88,14 @@ func TestCacheUpdate(t *testing.T) {
 }
 
 func TestUpdateOnPost(t *testing.T) {
-	handleCount := 0
-	assertCount := func(count int) {
-		if count != handleCount {
-			t.Fatalf("Handler called %d times, expected %d", handleCount, count)
+	var handleCount atomic.Int32
+	assertCount := func(count int32) {
+		if n := handleCount.Load(); count != n {
+			t.Fatalf("Handler called %d times, expected %d", n, count)
 		}
 	}
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		handleCount++
+		handleCount.Add(1)
 		w.Header().Add("Cache-Control", "max-age=60")
 		w.Write([]byte(fmt.Sprintf("So you wanted to %s?", r.Method)))
 	})
@@ -158,14 +170,16 @@ func TestUpdateBeforeRespondingOnRedirect(t *testing.T) {
 // 3. Turn off the handler, so we know the next request will be served from the cache.
 // 4. Request the resource again, which should be the updated resource served from the cache.
 func TestMaxAgeUpdate(t *testing.T) {
-	response := "Hello world"
+	var response atomic.Value
+	response.Store("Hello world")
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if response == "" {
+		body := response.Load().(string)
+		if body == "" {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
 		w.Header().Add("cache-control", "max-age=2")
-		w.Write([]byte(response))
+		w.Write([]byte(body))
 	})
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", handler)
@@ -173,9 +187,9 @@ func TestMaxAgeUpdate(t *testing.T) {
 	req, _ := http.NewRequest("GET", "/", nil)
 
 	mw.ServeHTTP(httptest.NewRecorder(), req)
-	response = "Hello world 2"
+	response.Store("Hello world 2")
 	time.Sleep(time.Second * 3)
-	response = ""
+	response.Store("")
 	rr := httptest.NewRecorder()
 	mw.ServeHTTP(rr, req)
 
@@ -198,15 +212,17 @@ func TestMaxAgeUpdate(t *testing.T) {
 // 6. Turn off the handler, so we know the next request will be served from the cache.
 // 7. Request the resource again, which should be the updated resource served from the cache.
 func TestUpdateDelay(t *testing.T) {
-	response := "Hello world"
+	var response atomic.Value
+	response.Store("Hello world")
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Cache-Control", "max-age=60")
-		if response == "" {
+		body := response.Load().(string)
+		if body == "" {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
-		w.Write([]byte(response))
+		w.Write([]byte(body))
 	})
 	mux.HandleFunc("/update", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == "POST" {
@@ -225,9 +241,9 @@ func TestUpdateDelay(t *testing.T) {
 	mw.ServeHTTP(httptest.NewRecorder(), get)  // 1.
 	mw.ServeHTTP(httptest.NewRecorder(), post) // 2.
 	time.Sleep(time.Millisecond * 100)         // 3.
-	response = "Hello world 2"                 // 4.
+	response.Store("Hello world 2")            // 4.
 	time.Sleep(time.Second)                    // 5.
-	response = ""                              // 6.
+	response.Store("")                         // 6.
 	mw.ServeHTTP(rr, get)                      // 7.
 
 	if body := rr.Body.String(); body != "Hello world 2" {
@@ -236,3 +252,987 @@ func TestUpdateDelay(t *testing.T) {
 
 	server.Shutdown(context.Background())
 }
+
+// TestIdleEntriesAreNotUpdated tests that entries nobody requests are purged instead of updated.
+//
+// This is what we will do and what we expect to happen:
+// 1. Request the resource, which will be cached for 2 seconds.
+// 2. Sleep until the entry has expired, it should not be updated since it was not requested again.
+// 3. Check that the origin was called only once and that the entry was purged.
+func TestIdleEntriesAreNotUpdated(t *testing.T) {
+	handleCount := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		handleCount++
+		w.Header().Add("Cache-Control", "max-age=2")
+		w.Write([]byte("Hello world"))
+	})
+	mw, server := startTestServerWithConfig(mux, 9006, Config{
+		IdleTimeout: time.Millisecond * 500,
+		PurgeIdle:   true,
+	})
+	req, _ := http.NewRequest("GET", "/", nil)
+
+	mw.ServeHTTP(httptest.NewRecorder(), req) // 1.
+	time.Sleep(time.Second * 3)               // 2.
+
+	if handleCount != 1 { // 3.
+		t.Fatalf("Handler called %d times, expected 1", handleCount)
+	}
+	if mw.cache.Has(mw.keyer.GetKeyPrefix(req)) {
+		t.Fatalf("Idle entry was not purged")
+	}
+
+	server.Shutdown(context.Background())
+}
+
+// TestRequestedEntriesAreNotIdle tests that requests not served from the cache count as accesses.
+//
+// This is what we will do and what we expect to happen:
+// 1. Request the resource, which will be cached for 2 seconds.
+// 2. Request it again with no-cache, so that it is fetched from the origin and stored again.
+// 3. Sleep until the entry has been updated, it is not idle since it was requested in step 2.
+func TestRequestedEntriesAreNotIdle(t *testing.T) {
+	var handleCount atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		handleCount.Add(1)
+		w.Header().Add("Cache-Control", "max-age=2")
+		w.Write([]byte("Hello world"))
+	})
+	mw, server := startTestServerWithConfig(mux, 9026, Config{
+		IdleTimeout: time.Millisecond * 2500,
+		PurgeIdle:   true,
+	})
+	defer server.Shutdown(context.Background())
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	mw.ServeHTTP(httptest.NewRecorder(), req) // 1.
+	time.Sleep(time.Second)
+	noCache, _ := http.NewRequest("GET", "/", nil)
+	noCache.Header.Set("Cache-Control", "no-cache")
+	mw.ServeHTTP(httptest.NewRecorder(), noCache) // 2.
+	time.Sleep(time.Millisecond * 2500)           // 3.
+
+	if count := handleCount.Load(); count < 3 {
+		t.Fatalf("Handler called %d times, expected at least 3", count)
+	}
+	if !mw.cache.Has(mw.keyer.GetKeyPrefix(req)) {
+		t.Fatalf("Requested entry was purged")
+	}
+}
+
+// TestAdaptiveOverrideValidatesNoCache tests that responses requiring revalidation are validated
+// even if the adaptive TTL override is enabled.
+func TestAdaptiveOverrideValidatesNoCache(t *testing.T) {
+	var validations atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Cache-Control", "max-age=60, no-cache")
+		w.Header().Add("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			validations.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("Hello world"))
+	})
+	mw, server := startTestServerWithConfig(mux, 9029, Config{
+		AdaptiveTTL: AdaptiveTTL{Enabled: true, Override: true, MaxFactor: 4},
+	})
+	defer server.Shutdown(context.Background())
+
+	mw.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	time.Sleep(time.Millisecond * 100)
+	rr := httptest.NewRecorder()
+	mw.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+
+	if validations.Load() != 1 || rr.Body.String() != "Hello world" {
+		t.Fatalf("Stored response was served with %d validations", validations.Load())
+	}
+}
+
+// TestStaleServedWhenUpdateFails tests that a transient origin failure does not purge the entry.
+//
+// This is what we will do and what we expect to happen:
+// 1. Request the resource, which will be cached for 2 seconds.
+// 2. Make the origin fail, so that updating the entry fails.
+// 3. Sleep until the entry is stale.
+// 4. Request the resource again, which should be the stale response served from the cache.
+func TestStaleServedWhenUpdateFails(t *testing.T) {
+	var failing atomic.Bool
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Add("Cache-Control", "max-age=2")
+		w.Write([]byte("Hello world"))
+	})
+	mw, server := startTestServerWithConfig(mux, 9007, Config{
+		MaxStaleness: time.Minute,
+	})
+	req, _ := http.NewRequest("GET", "/", nil)
+	rr := httptest.NewRecorder()
+
+	mw.ServeHTTP(httptest.NewRecorder(), req) // 1.
+	failing.Store(true)                       // 2.
+	time.Sleep(time.Second * 3)               // 3.
+	mw.ServeHTTP(rr, req)                     // 4.
+
+	if body := rr.Body.String(); body != "Hello world" {
+		t.Fatalf("body is %s", body)
+	}
+	if cs := rr.Header().Get("Cache-Status"); !strings.Contains(cs, "detail=stale") {
+		t.Fatalf("Cache-Status is %s", cs)
+	}
+
+	server.Shutdown(context.Background())
+}
+
+// TestPurgeWhenGone tests that the entry is purged when the origin says it is gone.
+func TestPurgeWhenGone(t *testing.T) {
+	var gone atomic.Bool
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if gone.Load() {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		w.Header().Add("Cache-Control", "max-age=2")
+		w.Write([]byte("Hello world"))
+	})
+	mw, server := startTestServerWithConfig(mux, 9008, Config{
+		MaxStaleness: time.Minute,
+	})
+	req, _ := http.NewRequest("GET", "/", nil)
+
+	mw.ServeHTTP(httptest.NewRecorder(), req)
+	gone.Store(true)
+	time.Sleep(time.Second * 2)
+
+	if mw.cache.Has(mw.keyer.GetKeyPrefix(req)) {
+		t.Fatalf("Gone entry was not purged")
+	}
+
+	server.Shutdown(context.Background())
+}
+
+// TestConditionalUpdate tests that updates validate the stored response instead of refetching it.
+//
+// This is what we will do and what we expect to happen:
+// 1. Request the resource with an ETag, which will be cached for 2 seconds.
+// 2. Sleep until the entry has been updated, which should be done with a conditional request.
+// 3. Request the resource again, which should be the stored body with the freshened headers.
+// 4. Check that the body was not stored again.
+func TestConditionalUpdate(t *testing.T) {
+	conditionalCount := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Cache-Control", "max-age=2")
+		w.Header().Add("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			conditionalCount++
+			w.Header().Add("X-Validated", "yes")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("Hello world"))
+	})
+	mw, server := startTestServer(mux, 9009)
+	req, _ := http.NewRequest("GET", "/", nil)
+	rr := httptest.NewRecorder()
+
+	mw.ServeHTTP(httptest.NewRecorder(), req) // 1.
+	time.Sleep(time.Millisecond * 2500)       // 2.
+	mw.ServeHTTP(rr, req)                     // 3.
+
+	if conditionalCount == 0 {
+		t.Fatalf("No conditional requests sent")
+	}
+	if body := rr.Body.String(); body != "Hello world" {
+		t.Fatalf("body is %s", body)
+	}
+	if cs := rr.Header().Get("Cache-Status"); !strings.Contains(cs, "hit") || rr.Header().Get("X-Validated") != "yes" {
+		t.Fatalf("Cache-Status is %s, headers %v", cs, rr.Header())
+	}
+	stats, found, err := mw.cache.KeyStats(mw.keyer.GetKeyPrefix(req)) // 4.
+	if err != nil || !found || stats.Updates != 1 {
+		t.Fatalf("Stats are %+v (%v)", stats, err)
+	}
+
+	server.Shutdown(context.Background())
+}
+
+// TestDelayedUpdatesAreCoalesced tests that delayed updates of the same path are stored as one job.
+func TestDelayedUpdatesAreCoalesced(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Cache-Control", "max-age=60")
+		w.Write([]byte("Hello world"))
+	})
+	mux.HandleFunc("/update", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("cache-update", "/; delay=1")
+		w.Write([]byte("done"))
+	})
+	mw, server := startTestServer(mux, 9010)
+	post, _ := http.NewRequest("POST", "/update", nil)
+
+	mw.ServeHTTP(httptest.NewRecorder(), post)
+	mw.ServeHTTP(httptest.NewRecorder(), post)
+	time.Sleep(time.Millisecond * 100)
+
+	jobs, err := mw.PendingUpdates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].Source != "POST /update" {
+		t.Fatalf("Pending updates are %+v", jobs)
+	}
+	time.Sleep(time.Second * 2)
+	if jobs, _ := mw.PendingUpdates(); len(jobs) != 0 {
+		t.Fatalf("Pending updates after running are %+v", jobs)
+	}
+
+	server.Shutdown(context.Background())
+}
+
+// TestCoalescedUpdatesAreNotPostponedForever tests that a key receiving delayed updates
+// more often than the delay is still updated.
+func TestCoalescedUpdatesAreNotPostponedForever(t *testing.T) {
+	var fetchCount atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fetchCount.Add(1)
+		w.Header().Add("Cache-Control", "max-age=60")
+		w.Write([]byte("Hello world"))
+	})
+	mux.HandleFunc("/update", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("cache-update", "/; delay=1")
+		w.Write([]byte("done"))
+	})
+	mw, server := startTestServer(mux, 9027)
+	defer server.Shutdown(context.Background())
+	post, _ := http.NewRequest("POST", "/update", nil)
+
+	for i := 0; i < 12; i++ {
+		mw.ServeHTTP(httptest.NewRecorder(), post)
+		time.Sleep(time.Millisecond * 300)
+	}
+	if count := fetchCount.Load(); count == 0 {
+		t.Fatalf("Delayed update was postponed while updates kept coming")
+	}
+}
+
+// TestDelayedUpdatesAreRestored tests that delayed updates stored before startup are run.
+func TestDelayedUpdatesAreRestored(t *testing.T) {
+	var handleCount atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		handleCount.Add(1)
+		w.Header().Add("Cache-Control", "max-age=60")
+		w.Write([]byte("Hello world"))
+	})
+	// store a job before the cache is started
+	provider := cache.NewSQLiteCache("")
+	provider.PutJob(cache.Job{
+		Key:       "http://localhost:9011:GET:/\t",
+		Due:       time.Now(),
+		Source:    "POST /update",
+		CreatedAt: time.Now(),
+	})
+	mw, server := startTestServer(mux, 9011)
+	time.Sleep(time.Millisecond * 500)
+
+	if count := handleCount.Load(); count != 1 {
+		t.Fatalf("Handler called %d times, expected 1", count)
+	}
+	if !mw.cache.Has("http://localhost:9011:GET:/\t") {
+		t.Fatalf("Restored update was not stored")
+	}
+
+	server.Shutdown(context.Background())
+}
+
+// TestFailedDelayedUpdateKeepsEntry tests that the last failed attempt of a delayed update
+// drops the job without replacing the stored response.
+func TestFailedDelayedUpdateKeepsEntry(t *testing.T) {
+	var failing atomic.Bool
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.Header().Add("Cache-Control", "max-age=60")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Add("Cache-Control", "max-age=60")
+		w.Write([]byte("Hello world"))
+	})
+	mw, server := startTestServer(mux, 9030)
+	defer server.Shutdown(context.Background())
+	req, _ := http.NewRequest("GET", "/", nil)
+	key := mw.keyer.GetKeyPrefix(req)
+
+	mw.ServeHTTP(httptest.NewRecorder(), req)
+	failing.Store(true)
+	mw.cache.PutJob(cache.Job{Key: key, Due: time.Now(), Attempts: maxJobAttempts - 1, CreatedAt: time.Now()})
+	mw.runJob(key)
+
+	if jobs, _ := mw.PendingUpdates(); len(jobs) != 0 {
+		t.Fatalf("Pending updates after the last attempt are %+v", jobs)
+	}
+	rr := httptest.NewRecorder()
+	mw.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Body.String() != "Hello world" {
+		t.Fatalf("Response after failed update is %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+// TestCacheUpdatePattern tests that a `Cache-Update` pattern purges all matching stored responses.
+func TestCacheUpdatePattern(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/products/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Cache-Control", "max-age=60")
+		w.Write([]byte("Product"))
+	})
+	mux.HandleFunc("/clear", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Cache-Update", "/products/*; mode=purge")
+		w.Write([]byte("done"))
+	})
+	mw, server := startTestServer(mux, 9012)
+	product1 := httptest.NewRequest("GET", "/products/1", nil)
+	product2 := httptest.NewRequest("GET", "/products/2?lang=fi", nil)
+
+	mw.ServeHTTP(httptest.NewRecorder(), product1)
+	mw.ServeHTTP(httptest.NewRecorder(), product2)
+	time.Sleep(time.Millisecond * 100)
+	mw.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/clear", nil))
+	time.Sleep(time.Millisecond * 100)
+
+	for _, req := range []*http.Request{product1, product2} {
+		if mw.cache.Has(mw.keyer.GetKeyPrefix(req)) {
+			t.Fatalf("%s was not purged", req.URL)
+		}
+	}
+
+	server.Shutdown(context.Background())
+}
+
+// TestCacheUpdatePurgesOnlyTheURI tests that `_` and `%` in a purged URI are not wildcards.
+func TestCacheUpdatePurgesOnlyTheURI(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Cache-Control", "max-age=60")
+		w.Write([]byte("Page"))
+	})
+	mux.HandleFunc("/clear", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Cache-Update", "/a_c; mode=purge")
+		w.Header().Add("Cache-Update", "/docs/x%2F; mode=purge")
+		w.Write([]byte("done"))
+	})
+	mw, server := startTestServer(mux, 9028)
+	defer server.Shutdown(context.Background())
+	purged := []*http.Request{httptest.NewRequest("GET", "/a_c", nil), httptest.NewRequest("GET", "/docs/x%2F", nil)}
+	kept := []*http.Request{httptest.NewRequest("GET", "/abc", nil), httptest.NewRequest("GET", "/docs/x%2Fy", nil)}
+
+	for _, req := range append(purged, kept...) {
+		mw.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	time.Sleep(time.Millisecond * 100)
+	mw.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/clear", nil))
+	time.Sleep(time.Millisecond * 100)
+
+	for _, req := range purged {
+		if mw.cache.Has(mw.keyer.GetKeyPrefix(req)) {
+			t.Fatalf("%s was not purged", req.URL)
+		}
+	}
+	for _, req := range kept {
+		if !mw.cache.Has(mw.keyer.GetKeyPrefix(req)) {
+			t.Fatalf("%s was purged", req.URL)
+		}
+	}
+}
+
+// TestUpdateAllVariants tests that an unsafe request updates all stored Vary variants of the URI.
+func TestUpdateAllVariants(t *testing.T) {
+	version := 1
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			version++
+			w.Write([]byte("done"))
+			return
+		}
+		w.Header().Add("Cache-Control", "max-age=60")
+		w.Header().Add("Vary", "Accept-Language")
+		w.Write([]byte(fmt.Sprintf("%s %d", r.Header.Get("Accept-Language"), version)))
+	})
+	mw, server := startTestServer(mux, 9013)
+	get := func(lang string) string {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Language", lang)
+		rr := httptest.NewRecorder()
+		mw.ServeHTTP(rr, req)
+		return rr.Body.String()
+	}
+
+	get("fi")
+	get("sv")
+	time.Sleep(time.Millisecond * 100)
+	mw.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil))
+	time.Sleep(time.Millisecond * 500)
+
+	if body := get("fi"); body != "fi 2" {
+		t.Fatalf("body is %s", body)
+	}
+	if body := get("sv"); body != "sv 2" {
+		t.Fatalf("body is %s", body)
+	}
+
+	server.Shutdown(context.Background())
+}
+
+// TestDependentsAreUpdated tests that responses declaring dependencies are updated transitively.
+//
+// This is what we will do and what we expect to happen:
+// 1. Request a list that depends on a category, which in turn depends on a product.
+// 2. Update the product with a POST request.
+// 3. Request the list again, which should have been updated via the category.
+func TestDependentsAreUpdated(t *testing.T) {
+	version := 1
+	mux := http.NewServeMux()
+	mux.HandleFunc("/product", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			version++
+		}
+		w.Header().Add("Cache-Control", "max-age=60")
+		w.Write([]byte(fmt.Sprintf("product %d", version)))
+	})
+	mux.HandleFunc("/category", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Cache-Control", "max-age=60")
+		w.Header().Add("Cache-Depends", "/product")
+		w.Write([]byte(fmt.Sprintf("category %d", version)))
+	})
+	mux.HandleFunc("/list", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Cache-Control", "max-age=60")
+		// the cycle should not cause infinite updates
+		w.Header().Add("Cache-Depends", "/category, /list")
+		w.Write([]byte(fmt.Sprintf("list %d", version)))
+	})
+	mw, server := startTestServer(mux, 9014)
+
+	mw.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/category", nil)) // 1.
+	mw.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/list", nil))
+	time.Sleep(time.Millisecond * 100)
+	mw.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/product", nil)) // 2.
+	time.Sleep(time.Millisecond * 500)
+
+	rr := httptest.NewRecorder()
+	mw.ServeHTTP(rr, httptest.NewRequest("GET", "/list", nil)) // 3.
+	if body := rr.Body.String(); body != "list 2" {
+		t.Fatalf("body is %s", body)
+	}
+
+	server.Shutdown(context.Background())
+}
+
+func TestScheduledRefresh(t *testing.T) {
+	version := 1
+	mux := http.NewServeMux()
+	mux.HandleFunc("/exports/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Cache-Control", "max-age=3600")
+		w.Write([]byte(fmt.Sprintf("%s %d", r.URL.Path, version)))
+	})
+	mw, server := startTestServer(mux, 9015)
+
+	mw.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/exports/a", nil))
+	mw.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/exports/b", nil))
+	time.Sleep(time.Millisecond * 100)
+	version = 2
+
+	run := mw.refreshSchedule(RefreshSchedule{Name: "exports", URIs: []string{"/exports/*", "/exports/c"}})
+	if run.Refreshed != 3 || run.Failed != 0 {
+		t.Fatalf("Refreshed %d, failed %d", run.Refreshed, run.Failed)
+	}
+	for _, path := range []string{"/exports/a", "/exports/c"} {
+		rr := httptest.NewRecorder()
+		mw.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if body := rr.Body.String(); body != path+" 2" {
+			t.Fatalf("body is %s", body)
+		}
+	}
+	if runs := mw.ScheduleRuns(); len(runs) != 1 || runs[0].Name != "exports" {
+		t.Fatalf("Runs %v", runs)
+	}
+
+	server.Shutdown(context.Background())
+}
+
+func TestPushedResponsesAreStored(t *testing.T) {
+	fetched := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pushed", func(w http.ResponseWriter, r *http.Request) {
+		fetched++
+		w.Header().Add("Cache-Control", "max-age=60")
+		w.Write([]byte("fetched"))
+	})
+	mw, server := startTestServerWithConfig(mux, 9016, Config{PushPath: "/_push", PushToken: "secret"})
+
+	push := `[
+		{"uri": "/pushed", "headers": {"Cache-Control": ["max-age=60"], "Vary": ["Accept-Language"]},
+		 "requestHeaders": {"Accept-Language": ["fi"]}, "body": "pushed fi"},
+		{"uri": "/pushed", "headers": {"Cache-Control": ["no-store"]}, "body": "not stored"}
+	]`
+	req := httptest.NewRequest("PUT", "/_push", strings.NewReader(push))
+	rr := httptest.NewRecorder()
+	mw.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("Status without token is %d", rr.Code)
+	}
+
+	req = httptest.NewRequest("PUT", "/_push", strings.NewReader(push))
+	req.Header.Set("Authorization", "Bearer secret")
+	rr = httptest.NewRecorder()
+	mw.ServeHTTP(rr, req)
+	if body := rr.Body.String(); !strings.Contains(body, `"stored":true`) || !strings.Contains(body, `"stored":false`) {
+		t.Fatalf("Push result is %s", body)
+	}
+
+	req = httptest.NewRequest("GET", "/pushed", nil)
+	req.Header.Set("Accept-Language", "fi")
+	rr = httptest.NewRecorder()
+	mw.ServeHTTP(rr, req)
+	if body := rr.Body.String(); body != "pushed fi" || fetched != 0 {
+		t.Fatalf("body is %s, fetched %d times", body, fetched)
+	}
+
+	server.Shutdown(context.Background())
+}
+
+// TestPushedPostAndDependents tests that a pushed POST response is found by a client request
+// with an equivalent body, and that pushing updates the dependents of the pushed URI.
+func TestPushedPostAndDependents(t *testing.T) {
+	var version atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/list", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Cache-Control", "max-age=60")
+		w.Header().Add("Cache-Depends", "/product")
+		w.Write([]byte(fmt.Sprintf("list %d", version.Add(1))))
+	})
+	mw, server := startTestServerWithConfig(mux, 9031, Config{PushPath: "/_push", PushToken: "secret"})
+	defer server.Shutdown(context.Background())
+	mw.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/list", nil))
+	time.Sleep(time.Millisecond * 100)
+
+	push := `[
+		{"uri": "/search", "method": "POST", "requestHeaders": {"Content-Type": ["application/json"]},
+		 "requestBody": "{\"q\": \"a\"}", "headers": {"Cache-Control": ["max-age=60, safe"]}, "body": "pushed"},
+		{"uri": "/product", "headers": {"Cache-Control": ["max-age=60"]}, "body": "product"}
+	]`
+	req := httptest.NewRequest("PUT", "/_push", strings.NewReader(push))
+	req.Header.Set("Authorization", "Bearer secret")
+	rr := httptest.NewRecorder()
+	mw.ServeHTTP(rr, req)
+	if body := rr.Body.String(); strings.Contains(body, `"stored":false`) {
+		t.Fatalf("Push result is %s", body)
+	}
+	time.Sleep(time.Millisecond * 200)
+
+	req = httptest.NewRequest("POST", "/search", strings.NewReader(`{"q":"a"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr = httptest.NewRecorder()
+	mw.ServeHTTP(rr, req)
+	if body := rr.Body.String(); body != "pushed" || !strings.Contains(rr.Header().Get("Cache-Status"), "hit") {
+		t.Fatalf("POST response is %d %s (%s)", rr.Code, body, rr.Header().Get("Cache-Status"))
+	}
+	rr = httptest.NewRecorder()
+	mw.ServeHTTP(rr, httptest.NewRequest("GET", "/list", nil))
+	if body := rr.Body.String(); body != "list 2" {
+		t.Fatalf("Dependent body is %s", body)
+	}
+}
+
+func TestSafePostIsReplayed(t *testing.T) {
+	version := 1
+	mux := http.NewServeMux()
+	mux.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Add("Cache-Control", "max-age=60, safe")
+		w.Write([]byte(fmt.Sprintf("%s %s %d", r.Header.Get("Content-Type"), body, version)))
+	})
+	mux.HandleFunc("/update", func(w http.ResponseWriter, r *http.Request) {
+		version++
+		w.Header().Add("Cache-Update", "/search")
+	})
+	mw, server := startTestServer(mux, 9017)
+
+	req := httptest.NewRequest("POST", "/search", strings.NewReader("q=cache"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	mw.ServeHTTP(httptest.NewRecorder(), req)
+	time.Sleep(time.Millisecond * 100)
+	mw.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/update", nil))
+	time.Sleep(time.Millisecond * 100)
+
+	req = httptest.NewRequest("POST", "/search", strings.NewReader("q=cache"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	mw.ServeHTTP(rr, req)
+	if body := rr.Body.String(); body != "application/x-www-form-urlencoded q=cache 2" {
+		t.Fatalf("body is %s", body)
+	}
+	if cs := rr.Header().Get("Cache-Status"); !strings.Contains(cs, "hit") {
+		t.Fatalf("Cache-Status is %s", cs)
+	}
+
+	server.Shutdown(context.Background())
+}
+
+func TestSafePostKeyedByBody(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Add("Cache-Control", "max-age=60, safe")
+		w.Write(body)
+	})
+	mw, server := startTestServer(mux, 9018)
+
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/search", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		mw.ServeHTTP(rr, req)
+		time.Sleep(time.Millisecond * 100)
+		return rr
+	}
+	post(`{"q": "a", "page": 1}`)
+	if rr := post(`{"q": "b"}`); rr.Body.String() != `{"q": "b"}` {
+		t.Fatalf("body is %s", rr.Body.String())
+	}
+	rr := post(`{"page":1,"q":"a"}`)
+	if body := rr.Body.String(); body != `{"q": "a", "page": 1}` {
+		t.Fatalf("body is %s", body)
+	}
+	if cs := rr.Header().Get("Cache-Status"); !strings.Contains(cs, "hit") {
+		t.Fatalf("Cache-Status is %s", cs)
+	}
+
+	server.Shutdown(context.Background())
+}
+
+func TestGraphQL(t *testing.T) {
+	version := 1
+	var received atomic.Value
+	mux := http.NewServeMux()
+	mux.HandleFunc("/graphql", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received.Store(string(body))
+		w.Header().Add("Cache-Control", "max-age=60, safe")
+		if strings.Contains(string(body), "mutation") {
+			version++
+			w.Header().Add("Cache-Types", "Product")
+		}
+		w.Write([]byte(fmt.Sprintf(`{"data": {"version": %d}, "extensions": {"cacheTypes": ["Product"]}}`, version)))
+	})
+	mw, server := startTestServerWithConfig(mux, 9019, Config{GraphQLPaths: []string{"/graphql"}})
+
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/graphql", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		mw.ServeHTTP(rr, req)
+		time.Sleep(time.Millisecond * 100)
+		return rr
+	}
+	query := `{"query": "query { product(id: 1) { name } }", "variables": {"a": 1, "b": 2}}`
+	post(query)
+	// the origin receives the query as sent by the client
+	if body := received.Load(); body != query {
+		t.Fatalf("Origin received %s", body)
+	}
+	rr := post(`{"variables": {"b": 2, "a": 1}, "query": "{product(id:1){name}}"}`)
+	if cs := rr.Header().Get("Cache-Status"); !strings.Contains(cs, "hit") {
+		t.Fatalf("Cache-Status of equal query is %s", cs)
+	}
+
+	mutation := `{"query": "mutation { updateProduct(id: 1) { name } }"}`
+	post(mutation)
+	if rr := post(mutation); strings.Contains(rr.Header().Get("Cache-Status"), "hit") || !strings.Contains(rr.Body.String(), `"version": 3`) {
+		t.Fatalf("Mutation served from cache: %s", rr.Body.String())
+	}
+
+	rr = post(`{"query": "{ product(id: 1) { name } }", "variables": {"a": 1, "b": 2}}`)
+	if body := rr.Body.String(); !strings.Contains(body, `"version": 3`) || !strings.Contains(rr.Header().Get("Cache-Status"), "hit") {
+		t.Fatalf("body is %s", body)
+	}
+
+	server.Shutdown(context.Background())
+}
+
+func TestOriginPoolFailover(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Cache-Control", "max-age=60")
+		w.Write([]byte("from pool"))
+	})
+	down, _ := url.Parse("http://localhost:9024")
+	up, _ := url.Parse("http://localhost:9023")
+	mw, server := startTestServerWithConfig(mux, 9023, Config{
+		OriginPool: pool.Config{Addresses: []url.URL{*down, *up}},
+	})
+
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		mw.ServeHTTP(rr, httptest.NewRequest("GET", fmt.Sprintf("/page%d", i), nil))
+		if rr.Code != http.StatusOK || rr.Body.String() != "from pool" {
+			t.Fatalf("Response %d is %d %s", i, rr.Code, rr.Body.String())
+		}
+	}
+	if stats := mw.OriginPoolStats(); stats[0].Errors == 0 || stats[1].Requests != 2 {
+		t.Fatalf("Pool stats are %+v", stats)
+	}
+
+	server.Shutdown(context.Background())
+	mw.Close()
+
+	// pools are ignored for origins not reached over HTTP
+	inProcess := CreateCache(Config{
+		Cache:          cache.NewSQLiteCache(""),
+		OriginHandler:  mux,
+		OriginPool:     pool.Config{Addresses: []url.URL{*down}},
+		DisableUpdates: true,
+	})
+	defer inProcess.Close()
+	rr := httptest.NewRecorder()
+	inProcess.ServeHTTP(rr, httptest.NewRequest("GET", "/in-process", nil))
+	if inProcess.pool != nil || rr.Body.String() != "from pool" {
+		t.Fatalf("Response is %s, pool is %v", rr.Body.String(), inProcess.pool)
+	}
+}
+
+func TestOfflineMode(t *testing.T) {
+	var down atomic.Bool
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Add("Cache-Control", "max-age=0")
+		w.Write([]byte("stored"))
+	})
+	mw, server := startTestServerWithConfig(mux, 9025, Config{
+		Offline: OfflineMode{FailureThreshold: 2, ProbeInterval: 100 * time.Millisecond},
+	})
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		mw.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		time.Sleep(time.Millisecond * 50)
+		return rr
+	}
+
+	get("/page")
+	down.Store(true)
+	get("/page")
+	get("/other")
+	if !mw.IsOffline() {
+		t.Fatalf("Origin failures not detected")
+	}
+	if rr := get("/page"); rr.Body.String() != "stored" || !strings.Contains(rr.Header().Get("Cache-Status"), "detail=offline") {
+		t.Fatalf("Offline response is %s (%s)", rr.Body.String(), rr.Header().Get("Cache-Status"))
+	}
+	if rr := get("/missing"); rr.Code != http.StatusServiceUnavailable || !strings.Contains(rr.Body.String(), "unavailable") {
+		t.Fatalf("Maintenance response is %d %s", rr.Code, rr.Body.String())
+	}
+
+	down.Store(false)
+	time.Sleep(time.Millisecond * 250)
+	if mw.IsOffline() {
+		t.Fatalf("Normal operation not resumed")
+	}
+
+	mw.SetOffline(true)
+	if rr := get("/missing"); rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Status when forced offline is %d", rr.Code)
+	}
+	mw.SetOffline(false)
+	if rr := get("/missing"); rr.Code != http.StatusOK {
+		t.Fatalf("Status when back online is %d", rr.Code)
+	}
+
+	server.Shutdown(context.Background())
+}
+
+func TestUnavailableStoredWithoutOfflineMode(t *testing.T) {
+	var requests atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Add("Cache-Control", "max-age=60")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	mw, server := startTestServerWithConfig(mux, 9033, Config{})
+	defer server.Shutdown(context.Background())
+
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		mw.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+		if rr.Code != http.StatusServiceUnavailable {
+			t.Fatalf("Status is %d", rr.Code)
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	// the cacheable response is stored as usual
+	if n := requests.Load(); n != 1 {
+		t.Fatalf("Origin requested %d times", n)
+	}
+}
+
+func TestFileSystemOrigin(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/index.html", []byte("version 1"), 0644)
+	originURL, _ := url.Parse("file://" + dir)
+	mw := CreateCache(Config{
+		Cache:                 cache.NewSQLiteCache(""),
+		OriginURL:             *originURL,
+		OriginFSWatchInterval: 50 * time.Millisecond,
+	})
+	get := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		mw.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+		time.Sleep(time.Millisecond * 100)
+		return rr
+	}
+
+	if rr := get(); rr.Body.String() != "version 1" || rr.Header().Get("ETag") == "" {
+		t.Fatalf("Response is %s %v", rr.Body.String(), rr.Header())
+	}
+	os.WriteFile(dir+"/index.html", []byte("version 2"), 0644)
+	time.Sleep(time.Millisecond * 200)
+	if rr := get(); rr.Body.String() != "version 2" || !strings.Contains(rr.Header().Get("Cache-Status"), "hit") {
+		t.Fatalf("Response after change is %s (%s)", rr.Body.String(), rr.Header().Get("Cache-Status"))
+	}
+	mw.Close()
+
+	// without updates, the responses of changed files are purged
+	mw = CreateCache(Config{
+		Cache:                 cache.NewSQLiteCache(""),
+		OriginURL:             *originURL,
+		OriginId:              "legacy",
+		OriginFSWatchInterval: 50 * time.Millisecond,
+		DisableUpdates:        true,
+	})
+	defer mw.Close()
+	get()
+	os.WriteFile(dir+"/index.html", []byte("version 3"), 0644)
+	time.Sleep(time.Millisecond * 200)
+	if rr := get(); rr.Body.String() != "version 3" || strings.Contains(rr.Header().Get("Cache-Status"), "hit") {
+		t.Fatalf("Response after change without updates is %s (%s)", rr.Body.String(), rr.Header().Get("Cache-Status"))
+	}
+}
+
+func TestOriginHandler(t *testing.T) {
+	calls := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/page", func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.RequestURI != "/page?x=1" || r.Host != "app.example" || r.URL.Host != "" || r.RemoteAddr != "192.0.2.1:1234" {
+			t.Errorf("Origin request is %s %s %s from %s", r.RequestURI, r.Host, r.URL.String(), r.RemoteAddr)
+		}
+		w.Header().Add("Cache-Control", "max-age=0")
+		w.Header().Add("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("from handler"))
+	})
+	mux.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) {
+		panic("broken")
+	})
+	mw := CreateCache(Config{Cache: cache.NewSQLiteCache(""), OriginHandler: mux, OriginHost: "app.example", DisableUpdates: true})
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Host = "app.example"
+		rr := httptest.NewRecorder()
+		mw.ServeHTTP(rr, req)
+		time.Sleep(time.Millisecond * 100)
+		return rr
+	}
+
+	get("/page?x=1")
+	// the stale response is validated with the handler
+	if rr := get("/page?x=1"); rr.Body.String() != "from handler" || !strings.Contains(rr.Header().Get("Cache-Status"), "hit") || calls != 2 {
+		t.Fatalf("Response is %s (%s), %d calls", rr.Body.String(), rr.Header().Get("Cache-Status"), calls)
+	}
+	if rr := get("/panic"); rr.Code != http.StatusBadGateway {
+		t.Fatalf("Status of panicking handler is %d", rr.Code)
+	}
+	// requests of the cache itself come from the loopback address
+	req, _ := http.NewRequest("GET", "http://app.example/page", nil)
+	if in := serverRequest(req); in.RemoteAddr != "127.0.0.1:0" {
+		t.Fatalf("Remote address of cache request is %q", in.RemoteAddr)
+	}
+}
+
+func TestFastCGIOrigin(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "fpm.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	calls := 0
+	go fcgi.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		env := fcgi.ProcessEnv(r)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(env["SCRIPT_FILENAME"] + " " + r.Host + " " + r.URL.RequestURI()))
+	}))
+
+	originURL, _ := url.Parse("fcgi+unix://" + socket)
+	mw := CreateCache(Config{
+		Cache:          cache.NewSQLiteCache(""),
+		OriginURL:      *originURL,
+		FastCGI:        fastcgi.Config{DocumentRoot: "/var/www"},
+		DisableUpdates: true,
+	})
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/products?page=2", nil)
+		req.Host = "shop.example"
+		rr := httptest.NewRecorder()
+		mw.ServeHTTP(rr, req)
+		time.Sleep(time.Millisecond * 100)
+		return rr
+	}
+
+	if rr := get(); rr.Code != http.StatusOK || rr.Body.String() != "/var/www/index.php shop.example /products?page=2" {
+		t.Fatalf("Response is %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := get(); !strings.Contains(rr.Header().Get("Cache-Status"), "hit") || calls != 1 {
+		t.Fatalf("Response is not stored (%s), %d calls", rr.Header().Get("Cache-Status"), calls)
+	}
+}
+
+func TestCloseStopsUpdates(t *testing.T) {
+	var requests atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Add("Cache-Control", "max-age=2")
+		w.Write([]byte("stored"))
+	})
+	mw, server := startTestServerWithConfig(mux, 9032, Config{})
+	defer server.Shutdown(context.Background())
+
+	mw.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	mw.Close()
+	time.Sleep(2 * time.Second)
+	if n := requests.Load(); n != 1 {
+		t.Fatalf("Origin requested %d times after closing, expected 1", n)
+	}
+	if _, _, err := mw.cache.Get("any"); err == nil {
+		t.Fatalf("Cache still open after closing")
+	}
+}
@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"bytes"
 	"database/sql"
 	"errors"
 	"sync"
@@ -21,6 +22,10 @@ type CacheProvider interface {
 	// It calls the callback in order to enable very large lists of keys to be
 	// processable (provider implementation might use paging, for instance).
 	AllKeys(prefix string, cb func(string))
+	// AllExpiring calls the given callback for each entry with the given key prefix
+	// that has an expiration time. The entries passed to the callback do not include the bytes.
+	// Entries stored without request and response times get their expiration time instead.
+	AllExpiring(prefix string, cb func(CacheEntry))
 	// All returns all cache entries that have the specific key prefix
 	All(prefix string) ([]CacheEntry, error)
 	// Get returns the cached response for the given key, if it exists.
@@ -32,6 +37,11 @@ type CacheProvider interface {
 	// It also sets an expiration time for the entry.
 	Put(key string, expires time.Time, bytes []byte) error
 	PutCE(CacheEntry) error
+	// UpdateHeader replaces the header section (status line and header fields) of the stored
+	// response with the bytes of the given entry, and sets the expiration and times of the entry.
+	// The stored body is kept. Nothing is updated and false is returned if the stored response
+	// does not start with the previous header section, i.e. if it has been replaced meanwhile.
+	UpdateHeader(ce CacheEntry, previousHeader []byte) (bool, error)
 	// Oldest returns the key and expiration time of the oldest entry in the cache.
 	// The oldest entry is the one with the earliest expiration time.
 	// It should not return items where the expiry is zero
@@ -41,6 +51,45 @@ type CacheProvider interface {
 	Purge(key string)
 	// Has checks if the specified key exists in the cache.
 	Has(key string) bool
+	// SetExpires changes the expiration time of the entry for the given key.
+	// Setting a zero time takes the entry out of update scheduling (see Oldest).
+	SetExpires(key string, expires time.Time) error
+	// RecordHit registers that the entry for the given key was used to satisfy a request.
+	// This is called for every cache hit, so implementations should batch the writes.
+	RecordHit(key string)
+	// RecordAccess registers that a client requested the entry for the given key,
+	// also when it was not served from the cache. Hits are accesses as well.
+	RecordAccess(key string)
+	// RecordUpdate registers that the entry for the given key was stored from an origin
+	// response, along with the time it took to get the response from the origin.
+	RecordUpdate(key string, latency time.Duration)
+	// Stats returns the access statistics for all entries with the given key prefix.
+	Stats(prefix string) ([]EntryStats, error)
+	// KeyStats returns the access statistics for the entry with the given key, including
+	// statistics not yet written to storage. The boolean is false if there are none.
+	KeyStats(key string) (EntryStats, bool, error)
+	// RecordBody registers the hash of the body stored for the entry with the given key,
+	// and returns the resulting change history of the entry.
+	RecordBody(key string, hash string) (ChangeHistory, error)
+	// PutRequest stores the serialized request that resulted in the entry with the given key,
+	// for requests that cannot be rebuilt from the key (e.g. safe POST requests with a body).
+	PutRequest(key string, req []byte) error
+	// GetRequest returns the serialized request stored for the given key, if any.
+	GetRequest(key string) ([]byte, bool, error)
+	// SetDependencies replaces the dependencies of the entry with the given key.
+	// Dependencies are identifiers (usually key prefixes) of the entries that the entry depends on.
+	SetDependencies(key string, dependencies []string) error
+	// Dependents returns the keys of all entries that depend on the given dependency.
+	Dependents(dependency string) ([]string, error)
+	// PutJob stores a pending job. An existing job with the same key is replaced.
+	PutJob(Job) error
+	// Jobs returns all pending jobs with the given key prefix, ordered by due time.
+	Jobs(prefix string) ([]Job, error)
+	// DeleteJob removes the pending job with the given key.
+	DeleteJob(key string) error
+	// Close stops the background processes of the provider, writes any buffered statistics
+	// and releases the storage. The provider must not be used after closing.
+	Close() error
 }
 
 type CacheEntry struct {
@@ -54,6 +103,10 @@ type CacheEntry struct {
 type SQLiteCache struct {
 	db         *sql.DB
 	writeMutex *sync.Mutex
+	stats      *statsBuffer
+	// closed on Close to stop flushing stats periodically
+	done      chan struct{}
+	closeOnce *sync.Once
 }
 
 // NewSQLiteCache creates a new cache with the given filename as the db.
@@ -80,23 +133,93 @@ func NewSQLiteCache(filename string) SQLiteCache {
 	if err != nil {
 		panic(err)
 	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS stats (
+		key TEXT PRIMARY KEY,
+		hits INTEGER,
+		last_hit INTEGER,
+		last_access INTEGER,
+		updates INTEGER,
+		last_update INTEGER,
+		created_at INTEGER,
+		fetch_latency INTEGER
+	)`)
+	if err != nil {
+		panic(err)
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS changes (
+		key TEXT PRIMARY KEY,
+		hash TEXT,
+		checks INTEGER,
+		changes INTEGER,
+		changed_at TEXT
+	)`)
+	if err != nil {
+		panic(err)
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS requests (
+		key TEXT PRIMARY KEY,
+		bytes BLOB
+	)`)
+	if err != nil {
+		panic(err)
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS dependencies (
+		dependency TEXT,
+		dependent TEXT,
+		PRIMARY KEY (dependency, dependent)
+	)`)
+	if err != nil {
+		panic(err)
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS dependent_idx ON dependencies (dependent)")
+	if err != nil {
+		panic(err)
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS jobs (
+		key TEXT PRIMARY KEY,
+		due INTEGER,
+		source TEXT,
+		attempts INTEGER,
+		created_at INTEGER
+	)`)
+	if err != nil {
+		panic(err)
+	}
 	_, err = db.Exec("PRAGMA journal_mode=WAL")
 	if err != nil {
 		panic(err)
 	}
-	return SQLiteCache{
+	s := SQLiteCache{
 		db:         db,
 		writeMutex: &sync.Mutex{},
+		stats:      newStatsBuffer(),
+		done:       make(chan struct{}),
+		closeOnce:  &sync.Once{},
 	}
+	go s.flushStatsLoop()
+	return s
+}
+
+func (s SQLiteCache) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		err = s.flushStats()
+		if closeErr := s.db.Close(); err == nil {
+			err = closeErr
+		}
+	})
+	return err
 }
 
 func (s SQLiteCache) All(prefix string) ([]CacheEntry, error) {
 	s.writeMutex.Lock()
 	defer s.writeMutex.Unlock()
 	entries := make([]CacheEntry, 0)
+	cond, args := keyPrefixCondition("key", prefix)
 	rows, err := s.db.Query(`SELECT 
 		key, expires, requested_at, received_at, bytes
-		FROM cache WHERE key LIKE ?`, prefix+"%")
+		FROM cache WHERE `+cond, args...)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return entries, nil
@@ -146,12 +269,34 @@ func (s SQLiteCache) PutCE(ce CacheEntry) error {
 	return err
 }
 
+func (s SQLiteCache) UpdateHeader(ce CacheEntry, previousHeader []byte) (bool, error) {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	var stored []byte
+	if err := s.db.QueryRow("SELECT bytes FROM cache WHERE key = ?", ce.Key).Scan(&stored); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	if !bytes.HasPrefix(stored, previousHeader) {
+		return false, nil
+	}
+	updated := make([]byte, 0, len(ce.Bytes)+len(stored)-len(previousHeader))
+	updated = append(updated, ce.Bytes...)
+	updated = append(updated, stored[len(previousHeader):]...)
+	_, err := s.db.Exec("UPDATE cache SET expires = ?, requested_at = ?, received_at = ?, bytes = ? WHERE key = ?",
+		ce.Expires.Unix(), ce.RequestedAt.Unix(), ce.ReceivedAt.Unix(), updated, ce.Key)
+	return err == nil, err
+}
+
 func (s SQLiteCache) Oldest(prefix string) (string, time.Time, error) {
 	var key string
 	var expires int64
+	cond, args := keyPrefixCondition("key", prefix)
 	err := s.db.QueryRow(
-		"SELECT key, expires FROM cache WHERE key LIKE ? AND expires > 0 ORDER BY expires ASC LIMIT 1",
-		prefix+"%",
+		"SELECT key, expires FROM cache WHERE "+cond+" AND expires > 0 ORDER BY expires ASC LIMIT 1",
+		args...,
 	).Scan(&key, &expires)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -162,6 +307,13 @@ func (s SQLiteCache) Oldest(prefix string) (string, time.Time, error) {
 	return key, time.Unix(expires, 0), nil
 }
 
+func (s SQLiteCache) SetExpires(key string, expires time.Time) error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	_, err := s.db.Exec("UPDATE cache SET expires = ? WHERE key = ?", toUnix(expires), key)
+	return err
+}
+
 func (s SQLiteCache) Purge(key string) {
 	s.writeMutex.Lock()
 	defer s.writeMutex.Unlock()
@@ -169,22 +321,44 @@ func (s SQLiteCache) Purge(key string) {
 	if err != nil {
 		panic(err)
 	}
-}
-
-func (s SQLiteCache) Has(key string) bool {
-	result, err := s.db.Exec("SELECT 1 FROM cache WHERE key = ?", key)
+	s.stats.drop(key)
+	_, err = s.db.Exec("DELETE FROM stats WHERE key = ?", key)
+	if err != nil {
+		panic(err)
+	}
+	_, err = s.db.Exec("DELETE FROM requests WHERE key = ?", key)
+	if err != nil {
+		panic(err)
+	}
+	_, err = s.db.Exec("DELETE FROM changes WHERE key = ?", key)
 	if err != nil {
 		panic(err)
 	}
-	rows, err := result.RowsAffected()
+	_, err = s.db.Exec("DELETE FROM dependencies WHERE dependent = ?", key)
 	if err != nil {
 		panic(err)
 	}
-	return rows > 0
+	_, err = s.db.Exec("DELETE FROM jobs WHERE key = ?", key)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (s SQLiteCache) Has(key string) bool {
+	var exists int
+	err := s.db.QueryRow("SELECT 1 FROM cache WHERE key = ?", key).Scan(&exists)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false
+		}
+		panic(err)
+	}
+	return true
 }
 
 func (s SQLiteCache) AllKeys(prefix string, cb func(string)) {
-	rows, err := s.db.Query("SELECT key FROM cache WHERE key LIKE ?", prefix+"%")
+	cond, args := keyPrefixCondition("key", prefix)
+	rows, err := s.db.Query("SELECT key FROM cache WHERE "+cond, args...)
 	if err != nil {
 		return
 	}
@@ -198,3 +372,79 @@ func (s SQLiteCache) AllKeys(prefix string, cb func(string)) {
 		cb(key)
 	}
 }
+
+func (s SQLiteCache) AllExpiring(prefix string, cb func(CacheEntry)) {
+	cond, args := keyPrefixCondition("key", prefix)
+	// entries stored without times (e.g. before the times were recorded) are treated as received
+	// at their expiry, so that they are updated when they expire instead of all at once
+	rows, err := s.db.Query(`SELECT key, expires, COALESCE(requested_at, received_at, expires), COALESCE(received_at, expires)
+		FROM cache WHERE `+cond+` AND expires > 0`, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry CacheEntry
+		var exp, req, rec int64
+		if err := rows.Scan(&entry.Key, &exp, &req, &rec); err != nil {
+			return
+		}
+		entry.Expires = time.Unix(exp, 0)
+		entry.RequestedAt = time.Unix(req, 0)
+		entry.ReceivedAt = time.Unix(rec, 0)
+		cb(entry)
+	}
+}
+
+func (s SQLiteCache) SetDependencies(key string, dependencies []string) error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM dependencies WHERE dependent = ?", key); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, dependency := range dependencies {
+		_, err := tx.Exec("INSERT OR IGNORE INTO dependencies (dependency, dependent) VALUES (?, ?)", dependency, key)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s SQLiteCache) Dependents(dependency string) ([]string, error) {
+	keys := make([]string, 0)
+	rows, err := s.db.Query("SELECT dependent FROM dependencies WHERE dependency = ?", dependency)
+	if err != nil {
+		return keys, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return keys, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// keyPrefixCondition returns an SQL condition matching the values of the column starting with the prefix,
+// along with its arguments. Unlike LIKE, it has no wildcards, is case-sensitive and can use indexes.
+func keyPrefixCondition(column, prefix string) (string, []interface{}) {
+	// the keys starting with the prefix sort before the prefix with its last byte incremented
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return column + " >= ? AND " + column + " < ?", []interface{}{prefix, string(end[:i+1])}
+		}
+	}
+	return column + " >= ?", []interface{}{prefix}
+}
@@ -0,0 +1,50 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeyPrefixHasNoWildcards(t *testing.T) {
+	c := NewSQLiteCache("file:key-prefix?mode=memory&cache=shared")
+	for _, key := range []string{"origin:GET:/a_c\t", "origin:GET:/abc\t", "origin:GET:/A_c\t", "origin:GET:/x%2Fy\t", "origin:GET:/x%2F\t"} {
+		c.PutCE(CacheEntry{Key: key, Expires: time.Now().Add(time.Minute)})
+	}
+
+	for prefix, expected := range map[string]string{
+		"origin:GET:/a_c\t":  "origin:GET:/a_c\t",
+		"origin:GET:/x%2F":   "origin:GET:/x%2F\t origin:GET:/x%2Fy\t",
+		"origin:GET:/x%2F\t": "origin:GET:/x%2F\t",
+	} {
+		keys := ""
+		c.AllKeys(prefix, func(key string) {
+			if keys != "" {
+				keys += " "
+			}
+			keys += key
+		})
+		if keys != expected {
+			t.Fatalf("Keys with prefix %q are %q", prefix, keys)
+		}
+	}
+	if entries, err := c.All("origin:GET:/a_"); err != nil || len(entries) != 1 {
+		t.Fatalf("Got %d entries (%v), expected 1", len(entries), err)
+	}
+}
+
+func TestExpiringWithoutTimes(t *testing.T) {
+	c := NewSQLiteCache("file:expiring-without-times?mode=memory&cache=shared")
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	c.Put("origin:GET:/legacy\t", expires, []byte{})
+
+	found := false
+	c.AllExpiring("origin:GET:", func(ce CacheEntry) {
+		found = true
+		if !ce.ReceivedAt.Equal(expires) || !ce.RequestedAt.Equal(expires) {
+			t.Fatalf("Entry without times is %+v", ce)
+		}
+	})
+	if !found {
+		t.Fatal("Entry not found")
+	}
+}
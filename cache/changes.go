@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Number of latest change times kept per entry.
+const maxChangeHistory = 10
+
+// ChangeHistory records how often the body of an entry actually changes.
+type ChangeHistory struct {
+	// Number of times the body was recorded, i.e. the entry was stored or updated.
+	Checks int64
+	// Number of times the recorded body differed from the previous one.
+	// The first recorded body counts as a change.
+	Changes int64
+	// Times of the latest changes, oldest first.
+	ChangedAt []time.Time
+}
+
+func (s SQLiteCache) RecordBody(key string, hash string) (ChangeHistory, error) {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	var h ChangeHistory
+	var previousHash, changedAt string
+	err := s.db.QueryRow("SELECT hash, checks, changes, changed_at FROM changes WHERE key = ?", key).
+		Scan(&previousHash, &h.Checks, &h.Changes, &changedAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return h, err
+	}
+	h.ChangedAt = parseTimes(changedAt)
+	h.Checks++
+	if hash != previousHash {
+		h.Changes++
+		h.ChangedAt = append(h.ChangedAt, time.Now())
+		if len(h.ChangedAt) > maxChangeHistory {
+			h.ChangedAt = h.ChangedAt[len(h.ChangedAt)-maxChangeHistory:]
+		}
+	}
+	_, err = s.db.Exec(`INSERT OR REPLACE INTO changes
+		(key, hash, checks, changes, changed_at) VALUES (?, ?, ?, ?, ?)`,
+		key, hash, h.Checks, h.Changes, formatTimes(h.ChangedAt))
+	return h, err
+}
+
+// formatTimes formats the times as comma-separated unix seconds.
+func formatTimes(times []time.Time) string {
+	parts := make([]string, len(times))
+	for i, t := range times {
+		parts[i] = strconv.FormatInt(t.Unix(), 10)
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseTimes parses comma-separated unix seconds, skipping invalid values.
+func parseTimes(s string) []time.Time {
+	times := make([]time.Time, 0)
+	for _, part := range strings.Split(s, ",") {
+		if sec, err := strconv.ParseInt(part, 10, 64); err == nil {
+			times = append(times, time.Unix(sec, 0))
+		}
+	}
+	return times
+}
@@ -0,0 +1,58 @@
+package cache
+
+import (
+	"time"
+)
+
+// Job is a pending cache update that is to be done at a later time.
+// Jobs are stored so that they survive restarts.
+type Job struct {
+	// Key of the cache entry to update, which is also the unique identifier of the job.
+	Key string
+	// Time at which the update should be done.
+	Due time.Time
+	// Description of the request that caused the job, e.g. `POST /products`.
+	Source string
+	// Number of failed update attempts.
+	Attempts int
+	// Time the job was first created.
+	CreatedAt time.Time
+}
+
+func (s SQLiteCache) PutJob(job Job) error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO jobs
+		(key, due, source, attempts, created_at) VALUES (?, ?, ?, ?, ?)`,
+		job.Key, job.Due.Unix(), job.Source, job.Attempts, job.CreatedAt.Unix())
+	return err
+}
+
+func (s SQLiteCache) Jobs(prefix string) ([]Job, error) {
+	jobs := make([]Job, 0)
+	cond, args := keyPrefixCondition("key", prefix)
+	rows, err := s.db.Query(`SELECT key, due, source, attempts, created_at
+		FROM jobs WHERE `+cond+` ORDER BY due ASC`, args...)
+	if err != nil {
+		return jobs, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var job Job
+		var due, createdAt int64
+		if err := rows.Scan(&job.Key, &due, &job.Source, &job.Attempts, &createdAt); err != nil {
+			return jobs, err
+		}
+		job.Due = time.Unix(due, 0)
+		job.CreatedAt = time.Unix(createdAt, 0)
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+func (s SQLiteCache) DeleteJob(key string) error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	_, err := s.db.Exec("DELETE FROM jobs WHERE key = ?", key)
+	return err
+}
@@ -0,0 +1,21 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJobsArePurged(t *testing.T) {
+	c := NewSQLiteCache("file:jobs-purged?mode=memory&cache=shared")
+	key := "origin:GET:/page\t"
+
+	c.Put(key, time.Now().Add(time.Minute), []byte{})
+	if err := c.PutJob(Job{Key: key, Due: time.Now().Add(time.Minute), CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	c.Purge(key)
+
+	if jobs, err := c.Jobs(key); err != nil || len(jobs) != 0 {
+		t.Fatalf("Got %v (%v), expected no jobs", jobs, err)
+	}
+}
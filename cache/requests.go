@@ -0,0 +1,22 @@
+package cache
+
+import (
+	"database/sql"
+	"errors"
+)
+
+func (s SQLiteCache) PutRequest(key string, req []byte) error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	_, err := s.db.Exec("INSERT OR REPLACE INTO requests (key, bytes) VALUES (?, ?)", key, req)
+	return err
+}
+
+func (s SQLiteCache) GetRequest(key string) ([]byte, bool, error) {
+	var req []byte
+	err := s.db.QueryRow("SELECT bytes FROM requests WHERE key = ?", key).Scan(&req)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	return req, err == nil, err
+}
@@ -0,0 +1,318 @@
+package cache
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// How often buffered statistics are written to the database.
+	statsFlushInterval = 10 * time.Second
+	// Number of buffered keys that triggers an immediate flush.
+	statsFlushSize = 1000
+)
+
+// EntryStats holds the access statistics of a single cache entry.
+type EntryStats struct {
+	Key string
+	// Number of times the entry was used to satisfy a request.
+	Hits int64
+	// Time of the latest hit. Zero if the entry has never been hit.
+	LastHit time.Time
+	// Time of the latest client request for the entry, whether it was a hit or not.
+	// Zero if the entry has never been requested by a client.
+	LastAccess time.Time
+	// Number of times the entry was stored from an origin response.
+	Updates int64
+	// Time of the latest update.
+	LastUpdate time.Time
+	// Time the statistics for the entry were first recorded.
+	CreatedAt time.Time
+	// Time it took to get the latest response from the origin.
+	FetchLatency time.Duration
+	// How often the body of the entry has changed when updated.
+	Changes ChangeHistory
+}
+
+// statsBuffer collects statistics in memory until they are flushed to storage.
+// The buffered values are deltas, i.e. hits and updates are added to the stored counts.
+type statsBuffer struct {
+	mutex   sync.Mutex
+	pending map[string]*EntryStats
+}
+
+func newStatsBuffer() *statsBuffer {
+	return &statsBuffer{
+		pending: make(map[string]*EntryStats),
+	}
+}
+
+// entry returns the pending stats for the key, creating them if needed.
+// The caller must hold the mutex.
+func (b *statsBuffer) entry(key string, now time.Time) *EntryStats {
+	e, ok := b.pending[key]
+	if !ok {
+		e = &EntryStats{Key: key, CreatedAt: now}
+		b.pending[key] = e
+	}
+	return e
+}
+
+// hit records a hit and returns the number of buffered keys.
+func (b *statsBuffer) hit(key string) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := time.Now()
+	e := b.entry(key, now)
+	e.Hits++
+	e.LastHit = now
+	e.LastAccess = now
+	return len(b.pending)
+}
+
+// access records a client request and returns the number of buffered keys.
+func (b *statsBuffer) access(key string) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := time.Now()
+	b.entry(key, now).LastAccess = now
+	return len(b.pending)
+}
+
+// update records an update and returns the number of buffered keys.
+func (b *statsBuffer) update(key string, latency time.Duration) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := time.Now()
+	e := b.entry(key, now)
+	e.Updates++
+	e.LastUpdate = now
+	e.FetchLatency = latency
+	return len(b.pending)
+}
+
+// get returns a copy of the pending stats for the key, if any.
+func (b *statsBuffer) get(key string) (EntryStats, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if e, ok := b.pending[key]; ok {
+		return *e, true
+	}
+	return EntryStats{}, false
+}
+
+func (b *statsBuffer) drop(key string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.pending, key)
+}
+
+// take returns the buffered stats and resets the buffer.
+func (b *statsBuffer) take() map[string]*EntryStats {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	pending := b.pending
+	b.pending = make(map[string]*EntryStats)
+	return pending
+}
+
+// restore puts stats returned by take back into the buffer, e.g. when writing them failed.
+// They are merged with the stats buffered meanwhile.
+func (b *statsBuffer) restore(taken map[string]*EntryStats) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for key, t := range taken {
+		e, ok := b.pending[key]
+		if !ok {
+			b.pending[key] = t
+			continue
+		}
+		e.Hits += t.Hits
+		e.Updates += t.Updates
+		e.LastHit = latest(e.LastHit, t.LastHit)
+		e.LastAccess = latest(e.LastAccess, t.LastAccess)
+		if e.Updates == t.Updates {
+			// no updates were buffered meanwhile
+			e.LastUpdate = t.LastUpdate
+			e.FetchLatency = t.FetchLatency
+		}
+		if t.CreatedAt.Before(e.CreatedAt) {
+			e.CreatedAt = t.CreatedAt
+		}
+	}
+}
+
+func (s SQLiteCache) RecordHit(key string) {
+	if s.stats.hit(key) >= statsFlushSize {
+		go s.flushStats()
+	}
+}
+
+func (s SQLiteCache) RecordAccess(key string) {
+	if s.stats.access(key) >= statsFlushSize {
+		go s.flushStats()
+	}
+}
+
+func (s SQLiteCache) RecordUpdate(key string, latency time.Duration) {
+	if s.stats.update(key, latency) >= statsFlushSize {
+		go s.flushStats()
+	}
+}
+
+const statsColumns = `stats.key, hits, last_hit, last_access, updates, last_update, created_at, fetch_latency,
+	COALESCE(checks, 0), COALESCE(changes, 0), COALESCE(changed_at, '')
+	FROM stats LEFT JOIN changes ON changes.key = stats.key`
+
+func (s SQLiteCache) Stats(prefix string) ([]EntryStats, error) {
+	if err := s.flushStats(); err != nil {
+		return nil, err
+	}
+	stats := make([]EntryStats, 0)
+	cond, args := keyPrefixCondition("stats.key", prefix)
+	rows, err := s.db.Query(`SELECT `+statsColumns+` WHERE `+cond, args...)
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		e, err := scanStats(rows)
+		if err != nil {
+			return stats, err
+		}
+		stats = append(stats, e)
+	}
+	return stats, rows.Err()
+}
+
+func (s SQLiteCache) KeyStats(key string) (EntryStats, bool, error) {
+	stored, err := scanStats(s.db.QueryRow(`SELECT `+statsColumns+` WHERE stats.key = ?`, key))
+	found := err == nil
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return stored, false, err
+	}
+	pending, buffered := s.stats.get(key)
+	if !buffered {
+		return stored, found, nil
+	}
+	if !found {
+		return pending, true, nil
+	}
+	// the buffered values are deltas to the stored ones
+	stored.Hits += pending.Hits
+	stored.Updates += pending.Updates
+	stored.LastHit = latest(stored.LastHit, pending.LastHit)
+	stored.LastAccess = latest(stored.LastAccess, pending.LastAccess)
+	stored.LastUpdate = latest(stored.LastUpdate, pending.LastUpdate)
+	if pending.Updates > 0 {
+		stored.FetchLatency = pending.FetchLatency
+	}
+	return stored, true, nil
+}
+
+// scanStats scans a row selected with statsColumns.
+func scanStats(row interface{ Scan(...interface{}) error }) (EntryStats, error) {
+	var e EntryStats
+	var lastHit, lastAccess, lastUpdate, createdAt, latency int64
+	var changedAt string
+	if err := row.Scan(&e.Key, &e.Hits, &lastHit, &lastAccess, &e.Updates, &lastUpdate, &createdAt, &latency,
+		&e.Changes.Checks, &e.Changes.Changes, &changedAt); err != nil {
+		return e, err
+	}
+	e.Changes.ChangedAt = parseTimes(changedAt)
+	e.LastHit = fromUnix(lastHit)
+	e.LastAccess = fromUnix(lastAccess)
+	e.LastUpdate = fromUnix(lastUpdate)
+	e.CreatedAt = fromUnix(createdAt)
+	e.FetchLatency = time.Duration(latency) * time.Millisecond
+	return e, nil
+}
+
+// latest returns the later of the two times.
+func latest(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
+// flushStatsLoop periodically flushes the buffered statistics until the cache is closed.
+func (s SQLiteCache) flushStatsLoop() {
+	ticker := time.NewTicker(statsFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.flushStats()
+		}
+	}
+}
+
+// flushStats writes the buffered statistics to the database in a single transaction.
+// The write mutex is held from taking the stats until they are written, so that stats of
+// entries purged meanwhile are not written back. If writing fails, the stats are kept buffered.
+func (s SQLiteCache) flushStats() error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	pending := s.stats.take()
+	if len(pending) == 0 {
+		return nil
+	}
+	err := s.writeStats(pending)
+	if err != nil {
+		s.stats.restore(pending)
+	}
+	return err
+}
+
+// writeStats adds the given stats to the stored ones. The write mutex must be held.
+func (s SQLiteCache) writeStats(pending map[string]*EntryStats) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`INSERT INTO stats
+		(key, hits, last_hit, last_access, updates, last_update, created_at, fetch_latency)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(key) DO UPDATE SET
+			hits = hits + excluded.hits,
+			last_hit = MAX(last_hit, excluded.last_hit),
+			last_access = MAX(last_access, excluded.last_access),
+			updates = updates + excluded.updates,
+			last_update = MAX(last_update, excluded.last_update),
+			fetch_latency = CASE WHEN excluded.updates > 0 THEN excluded.fetch_latency ELSE fetch_latency END`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, e := range pending {
+		_, err := stmt.Exec(e.Key, e.Hits, toUnix(e.LastHit), toUnix(e.LastAccess), e.Updates, toUnix(e.LastUpdate),
+			toUnix(e.CreatedAt), e.FetchLatency.Milliseconds())
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// toUnix converts the time to unix seconds, keeping zero times as zero.
+func toUnix(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// fromUnix converts unix seconds to time, keeping zero as the zero time.
+func fromUnix(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
@@ -0,0 +1,155 @@
+package cache
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStatsAreAccumulated(t *testing.T) {
+	c := NewSQLiteCache("file:stats-accumulated?mode=memory&cache=shared")
+	key := "origin:GET:/page\t"
+
+	c.RecordUpdate(key, 120*time.Millisecond)
+	c.RecordHit(key)
+	c.RecordHit(key)
+	// flush in between in order to test that counts are added to stored values
+	if _, err := c.Stats(key); err != nil {
+		t.Fatal(err)
+	}
+	c.RecordHit(key)
+	c.RecordUpdate(key, 80*time.Millisecond)
+
+	stats, err := c.Stats(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 {
+		t.Fatalf("Got %d stats entries, expected 1", len(stats))
+	}
+	s := stats[0]
+	if s.Hits != 3 || s.Updates != 2 {
+		t.Fatalf("Hits %d, updates %d", s.Hits, s.Updates)
+	}
+	if s.FetchLatency != 80*time.Millisecond {
+		t.Fatalf("Fetch latency is %s", s.FetchLatency)
+	}
+	if s.LastHit.IsZero() || s.LastUpdate.IsZero() || s.CreatedAt.IsZero() {
+		t.Fatalf("Times not set: %+v", s)
+	}
+}
+
+func TestStatsArePurged(t *testing.T) {
+	c := NewSQLiteCache("file:stats-purged?mode=memory&cache=shared")
+	key := "origin:GET:/page\t"
+
+	c.RecordHit(key)
+	c.Stats(key)
+	c.RecordHit(key)
+	c.Purge(key)
+
+	if stats, err := c.Stats(key); err != nil || len(stats) != 0 {
+		t.Fatalf("Got %v (%v), expected no stats", stats, err)
+	}
+}
+
+func TestBodyChangesAreRecorded(t *testing.T) {
+	c := NewSQLiteCache("file:stats-changes?mode=memory&cache=shared")
+	key := "origin:GET:/page\t"
+
+	c.RecordUpdate(key, 0)
+	c.RecordBody(key, "a")
+	c.RecordBody(key, "a")
+	h, err := c.RecordBody(key, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Checks != 3 || h.Changes != 2 || len(h.ChangedAt) != 2 {
+		t.Fatalf("Got %+v, expected 3 checks and 2 changes", h)
+	}
+
+	stats, err := c.Stats(key)
+	if err != nil || len(stats) != 1 {
+		t.Fatalf("Got %v (%v), expected 1 stats entry", stats, err)
+	}
+	if changes := stats[0].Changes; changes.Checks != 3 || changes.Changes != 2 || len(changes.ChangedAt) != 2 {
+		t.Fatalf("Got %+v in stats", changes)
+	}
+}
+
+func TestKeyStatsIncludeBuffered(t *testing.T) {
+	c := NewSQLiteCache("file:stats-key?mode=memory&cache=shared")
+	key := "origin:GET:/page\t"
+
+	if _, found, err := c.KeyStats(key); err != nil || found {
+		t.Fatalf("Found stats (%v) for unknown key", err)
+	}
+	c.RecordHit(key)
+	c.RecordHit("origin:GET:/page/other\t")
+	c.Stats(key)
+	c.RecordHit(key)
+	c.RecordAccess(key)
+
+	s, found, err := c.KeyStats(key)
+	if err != nil || !found {
+		t.Fatalf("No stats found (%v)", err)
+	}
+	if s.Hits != 2 || s.LastAccess.Before(s.LastHit) || s.CreatedAt.IsZero() {
+		t.Fatalf("Got %+v", s)
+	}
+}
+
+func TestSetExpiresZero(t *testing.T) {
+	c := NewSQLiteCache("file:set-expires?mode=memory&cache=shared")
+	key := "origin:GET:/page\t"
+
+	c.Put(key, time.Now().Add(time.Minute), []byte{})
+	if err := c.SetExpires(key, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	var expires int64
+	if err := c.db.QueryRow("SELECT expires FROM cache WHERE key = ?", key).Scan(&expires); err != nil || expires != 0 {
+		t.Fatalf("Stored expiry is %d (%v)", expires, err)
+	}
+}
+
+func TestStatsAreFlushedOnClose(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "cache.db")
+	key := "origin:GET:/page\t"
+
+	c := NewSQLiteCache(filename)
+	c.RecordHit(key)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c = NewSQLiteCache(filename)
+	defer c.Close()
+	if s, found, err := c.KeyStats(key); err != nil || !found || s.Hits != 1 {
+		t.Fatalf("Got %+v (%v) after reopening", s, err)
+	}
+}
+
+func TestStatsAreKeptWhenFlushFails(t *testing.T) {
+	c := NewSQLiteCache("file:stats-failed?mode=memory&cache=shared")
+	key := "origin:GET:/page\t"
+
+	c.RecordHit(key)
+	c.db.Close()
+	c.RecordHit(key)
+	if err := c.flushStats(); err == nil {
+		t.Fatal("Flushing to a closed database succeeded")
+	}
+	if s, found := c.stats.get(key); !found || s.Hits != 2 {
+		t.Fatalf("Buffered stats are %+v", s)
+	}
+
+	// stats buffered while writing are merged with the restored ones
+	b := newStatsBuffer()
+	b.update(key, time.Second)
+	taken := b.take()
+	b.hit(key)
+	b.restore(taken)
+	if s, _ := b.get(key); s.Hits != 1 || s.Updates != 1 || s.FetchLatency != time.Second {
+		t.Fatalf("Merged stats are %+v", s)
+	}
+}
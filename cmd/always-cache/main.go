@@ -1,15 +1,29 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	alwayscache "github.com/always-cache/always-cache"
 	"github.com/always-cache/always-cache/cache"
+	"github.com/always-cache/always-cache/pkg/cron"
+	"github.com/always-cache/always-cache/pkg/fastcgi"
+	budget "github.com/always-cache/always-cache/pkg/origin-budget"
+	pool "github.com/always-cache/always-cache/pkg/origin-pool"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -18,6 +32,8 @@ import (
 var (
 	// CLI flags
 	portFlag           int
+	socketFlag         string
+	socketModeFlag     string
 	originFlag         string
 	addrFlag           string
 	hostFlag           string
@@ -25,20 +41,120 @@ var (
 	legacyModeFlag     bool
 	verbosityTraceFlag bool
 	logFilenameFlag    string
+	idleTimeoutFlag    time.Duration
+	idleGraceFlag      time.Duration
+	purgeIdleFlag      bool
+	updateWorkersFlag  int
+	refreshAheadFlag   float64
+	refreshJitterFlag  float64
+	maxStalenessFlag   time.Duration
+	dependencyDepth    int
+	schedulesFlag      schedules
+	scheduleConcurFlag int
+	originConcurFlag   int
+	originRPSFlag      float64
+	originSlowFlag     time.Duration
+	originErrorsFlag   float64
+	originPoolFlag     string
+	poolBalancingFlag  string
+	poolHealthFlag     string
+	poolIntervalFlag   time.Duration
+	dialTimeoutFlag    time.Duration
+	tlsTimeoutFlag     time.Duration
+	headerTimeoutFlag  time.Duration
+	idleConnFlag       time.Duration
+	maxIdleConnsFlag   int
+	maxIdleHostFlag    int
+	maxConnsHostFlag   int
+	originHTTP2Flag    bool
+	originCAFlag       string
+	originCertFlag     string
+	originKeyFlag      string
+	insecureTLSFlag    bool
+	offlineFlag        bool
+	offlineThreshold   int
+	offlineProbeFlag   string
+	maintenanceFlag    string
+	fsCacheControlFlag string
+	fsWatchFlag        time.Duration
+	fcgiRootFlag       string
+	fcgiIndexFlag      string
+	fcgiHTTPSFlag      bool
+	adaptiveFlag       bool
+	adaptiveMinFlag    float64
+	adaptiveMaxFlag    float64
+	adaptiveOverride   bool
+	pushPathFlag       string
+	pushTokenFlag      string
+	graphQLPathsFlag   string
+	virtualHostsFlag   virtualHosts
+	routesFlag         routes
+	stripRoutesFlag    bool
 
 	// this is set by goreleaser
 	version string
 )
 
 func init() {
-	flag.StringVar(&originFlag, "origin", "", "Origin URL to proxy to (overrides addr and host)")
+	flag.StringVar(&originFlag, "origin", "", "Origin URL to proxy to, file:// URL of a directory to serve, or fcgi:// or fcgi+unix:// URL of a FastCGI server (overrides addr and host)")
+	flag.Var(&virtualHostsFlag, "vhost", "Virtual host and its origin URL, e.g. 'www.example.com=https://10.0.0.1' (repeatable, overrides origin)")
+	flag.Var(&routesFlag, "route", "Path prefix and its origin URL, e.g. '/api/=http://localhost:8082/v1' (repeatable, overrides origin)")
+	flag.BoolVar(&stripRoutesFlag, "strip-route-prefix", false, "Remove the route path prefix before forwarding requests to the origin")
 	flag.StringVar(&addrFlag, "addr", "", "Origin IP address to proxy to")
 	flag.StringVar(&hostFlag, "host", "", "Hostname of origin")
-	flag.IntVar(&portFlag, "port", 8080, "Port to listen on")
+	flag.IntVar(&portFlag, "port", 8080, "Port to listen on (0 to only listen on the socket)")
+	flag.StringVar(&socketFlag, "socket", "", "Unix socket to listen on, in addition to the port")
+	flag.StringVar(&socketModeFlag, "socket-mode", "0660", "File permissions of the Unix socket (octal)")
 	flag.StringVar(&dbFilenameFlag, "db", "cache.db", "Cache DB file name (use 'memory' for in-memory db)")
 	flag.BoolVar(&legacyModeFlag, "legacy", false, "Legacy mode: do not update, only invalidate if needed")
 	flag.BoolVar(&verbosityTraceFlag, "vv", false, "Verbosity: trace logging")
 	flag.StringVar(&logFilenameFlag, "log-file", "", "Log file to use (in addition to stdout)")
+	flag.DurationVar(&idleTimeoutFlag, "idle-timeout", 0, "Do not update entries not requested within this duration (0 updates all)")
+	flag.DurationVar(&idleGraceFlag, "idle-grace", 0, "Additional idle time for entries never requested, e.g. warmed entries")
+	flag.BoolVar(&purgeIdleFlag, "idle-purge", false, "Purge idle entries instead of leaving them to expire")
+	flag.IntVar(&updateWorkersFlag, "update-workers", 4, "Number of concurrent workers updating expiring entries")
+	flag.Float64Var(&refreshAheadFlag, "refresh-ahead", 0.9, "Fraction of the entry lifetime after which it is updated")
+	flag.DurationVar(&maxStalenessFlag, "max-staleness", 24*time.Hour, "How long to serve stale content when updating it fails")
+	flag.IntVar(&dependencyDepth, "dependency-depth", 5, "Maximum depth of transitive updates of dependent responses")
+	flag.Float64Var(&refreshJitterFlag, "refresh-jitter", 0.05, "Maximum random fraction of the entry lifetime to update earlier")
+	flag.Var(&schedulesFlag, "schedule", "Refresh schedule as cron expression and comma-separated URIs, e.g. '0 3 * * * /exports/*' (repeatable)")
+	flag.IntVar(&scheduleConcurFlag, "schedule-concurrency", 2, "Maximum number of concurrent fetches per schedule run")
+	flag.IntVar(&originConcurFlag, "origin-concurrency", 8, "Maximum concurrent origin fetches before background fetches wait (0 for no limit)")
+	flag.Float64Var(&originRPSFlag, "origin-rps", 0, "Maximum background fetches per second (0 for no limit)")
+	flag.DurationVar(&originSlowFlag, "origin-slow-latency", 0, "Slow down background fetches when average origin latency exceeds this (0 disables)")
+	flag.StringVar(&originPoolFlag, "origin-pool", "", "Comma-separated URLs of servers serving the origin, e.g. 'https://10.0.0.1,https://10.0.0.2'")
+	flag.StringVar(&poolBalancingFlag, "origin-pool-balancing", "round-robin", "Origin pool balancing: round-robin or least-connections")
+	flag.StringVar(&poolHealthFlag, "origin-pool-health-path", "", "Path for active health checks of origin pool servers (disabled if empty)")
+	flag.DurationVar(&poolIntervalFlag, "origin-pool-health-interval", 10*time.Second, "Interval of origin pool health checks")
+	flag.DurationVar(&dialTimeoutFlag, "origin-dial-timeout", 30*time.Second, "Timeout for connecting to the origin")
+	flag.DurationVar(&tlsTimeoutFlag, "origin-tls-timeout", 10*time.Second, "Timeout for TLS handshakes with the origin")
+	flag.DurationVar(&headerTimeoutFlag, "origin-response-timeout", 0, "Timeout for receiving response headers from the origin (0 for no limit)")
+	flag.DurationVar(&idleConnFlag, "origin-idle-timeout", 90*time.Second, "How long idle origin connections are kept open")
+	flag.IntVar(&maxIdleConnsFlag, "origin-max-idle-conns", 100, "Maximum number of idle origin connections")
+	flag.IntVar(&maxIdleHostFlag, "origin-max-idle-conns-per-host", 2, "Maximum number of idle connections per origin server")
+	flag.IntVar(&maxConnsHostFlag, "origin-max-conns-per-host", 0, "Maximum number of connections per origin server (0 for no limit)")
+	flag.BoolVar(&originHTTP2Flag, "origin-http2", true, "Use HTTP/2 with TLS origins supporting it")
+	flag.StringVar(&originCAFlag, "origin-ca", "", "PEM file of certificate authorities trusted for origin certificates (system roots if empty)")
+	flag.StringVar(&originCertFlag, "origin-cert", "", "PEM file of the client certificate presented to the origin (mutual TLS)")
+	flag.StringVar(&originKeyFlag, "origin-key", "", "PEM file of the private key of the client certificate")
+	flag.BoolVar(&insecureTLSFlag, "origin-insecure-skip-verify", false, "Accept any origin certificate (for testing only)")
+	flag.BoolVar(&offlineFlag, "offline", false, "Start in offline mode, serving stored responses without contacting the origin")
+	flag.IntVar(&offlineThreshold, "offline-threshold", 0, "Consecutive origin failures after which stored responses are served regardless of freshness (0 disables)")
+	flag.StringVar(&offlineProbeFlag, "offline-probe-path", "/", "Path requested to check if the origin is available again")
+	flag.StringVar(&maintenanceFlag, "maintenance-page", "", "HTML file served for requests without stored response while offline")
+	flag.StringVar(&fsCacheControlFlag, "file-cache-control", "max-age=60", "Cache-Control header of files served from a file:// origin")
+	flag.DurationVar(&fsWatchFlag, "file-watch-interval", 10*time.Second, "How often a file:// origin is checked for changes, walking the whole directory each time (0 disables)")
+	flag.StringVar(&fcgiRootFlag, "fcgi-root", "", "Document root of the application on a FastCGI origin, e.g. '/var/www/html'")
+	flag.StringVar(&fcgiIndexFlag, "fcgi-index", "index.php", "Script of a FastCGI origin handling requests not naming a script")
+	flag.BoolVar(&fcgiHTTPSFlag, "fcgi-https", false, "Pass requests to a FastCGI origin as HTTPS, e.g. when behind a TLS terminating proxy")
+	flag.StringVar(&pushPathFlag, "push-path", "/.always-cache/push", "Path of the endpoint for pushing responses into the cache")
+	flag.StringVar(&pushTokenFlag, "push-token", "", "Bearer token for pushing responses (push endpoint disabled if empty)")
+	flag.StringVar(&graphQLPathsFlag, "graphql", "", "Comma-separated paths of GraphQL endpoints whose queries are cached, e.g. '/graphql'")
+	flag.BoolVar(&adaptiveFlag, "adaptive-ttl", false, "Adapt refresh intervals to how often content actually changes")
+	flag.Float64Var(&adaptiveMinFlag, "adaptive-min", 0.1, "Minimum adaptive refresh interval as a fraction of the origin lifetime")
+	flag.Float64Var(&adaptiveMaxFlag, "adaptive-max", 1, "Maximum adaptive refresh interval as a fraction of the origin lifetime")
+	flag.BoolVar(&adaptiveOverride, "adaptive-override", false, "Allow serving rarely changing content beyond the origin lifetime (up to adaptive-max)")
+	flag.Float64Var(&originErrorsFlag, "origin-max-error-rate", 0.5, "Slow down background fetches when the fraction of 5xx responses exceeds this (0 disables)")
 
 	if version == "" {
 		version = "DEV"
@@ -75,10 +191,146 @@ func main() {
 		dbFilename = "file::memory:?cache=shared"
 	}
 
+	var maintenancePage []byte
+	if maintenanceFlag != "" {
+		var err error
+		if maintenancePage, err = os.ReadFile(maintenanceFlag); err != nil {
+			log.Fatal().Err(err).Msg("Cannot read maintenance page")
+		}
+	}
+
+	originTransport := alwayscache.OriginTransport{
+		DialTimeout:           dialTimeoutFlag,
+		TLSHandshakeTimeout:   tlsTimeoutFlag,
+		ResponseHeaderTimeout: headerTimeoutFlag,
+		IdleConnTimeout:       idleConnFlag,
+		MaxIdleConns:          maxIdleConnsFlag,
+		MaxIdleConnsPerHost:   maxIdleHostFlag,
+		MaxConnsPerHost:       maxConnsHostFlag,
+		DisableHTTP2:          !originHTTP2Flag,
+		InsecureSkipVerify:    insecureTLSFlag,
+	}
+	if originCAFlag != "" {
+		pem, err := os.ReadFile(originCAFlag)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Cannot read origin CA file")
+		}
+		originTransport.RootCAs = x509.NewCertPool()
+		if !originTransport.RootCAs.AppendCertsFromPEM(pem) {
+			log.Fatal().Str("file", originCAFlag).Msg("No certificates found in origin CA file")
+		}
+	}
+	if originCertFlag != "" {
+		cert, err := tls.LoadX509KeyPair(originCertFlag, originKeyFlag)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Cannot load origin client certificate")
+		}
+		originTransport.Certificates = []tls.Certificate{cert}
+	}
+	if insecureTLSFlag {
+		log.Warn().Msg("Origin certificates are not verified")
+	}
+
 	// always-cache origin instance
 	cacheConfig := alwayscache.Config{
-		Cache:          cache.NewSQLiteCache(dbFilename),
-		DisableUpdates: legacyModeFlag,
+		Cache:               cache.NewSQLiteCache(dbFilename),
+		DisableUpdates:      legacyModeFlag,
+		IdleTimeout:         idleTimeoutFlag,
+		IdleGracePeriod:     idleGraceFlag,
+		PurgeIdle:           purgeIdleFlag,
+		UpdateWorkers:       updateWorkersFlag,
+		RefreshAhead:        refreshAheadFlag,
+		RefreshJitter:       refreshJitterFlag,
+		MaxStaleness:        maxStalenessFlag,
+		MaxDependencyDepth:  dependencyDepth,
+		Schedules:           schedulesFlag,
+		ScheduleConcurrency: scheduleConcurFlag,
+		PushPath:            pushPathFlag,
+		PushToken:           pushTokenFlag,
+		GraphQLPaths:        graphQLPaths(graphQLPathsFlag),
+		AdaptiveTTL: alwayscache.AdaptiveTTL{
+			Enabled:   adaptiveFlag,
+			MinFactor: adaptiveMinFlag,
+			MaxFactor: adaptiveMaxFlag,
+			Override:  adaptiveOverride,
+		},
+		OriginFSCacheControl:  fsCacheControlFlag,
+		OriginFSWatchInterval: fsWatchFlag,
+		FastCGI: fastcgi.Config{
+			DocumentRoot: fcgiRootFlag,
+			Index:        fcgiIndexFlag,
+			HTTPS:        fcgiHTTPSFlag,
+		},
+		Offline: alwayscache.OfflineMode{
+			Forced:           offlineFlag,
+			FailureThreshold: offlineThreshold,
+			ProbePath:        offlineProbeFlag,
+			MaintenancePage:  maintenancePage,
+		},
+		OriginPool: pool.Config{
+			Addresses:      poolAddresses(originPoolFlag),
+			Balancing:      pool.Balancing(poolBalancingFlag),
+			HealthPath:     poolHealthFlag,
+			HealthInterval: poolIntervalFlag,
+		},
+		OriginTransport: originTransport,
+		OriginBudget: budget.Config{
+			MaxConcurrent:     originConcurFlag,
+			RequestsPerSecond: originRPSFlag,
+			SlowLatency:       originSlowFlag,
+			MaxErrorRate:      originErrorsFlag,
+		},
+	}
+
+	if len(virtualHostsFlag) > 0 && len(routesFlag) > 0 {
+		log.Fatal().Msg("Virtual hosts and routes cannot be combined")
+	}
+
+	// serve multiple origins from the same cache, with the same settings for each
+	if len(routesFlag) > 0 || len(virtualHostsFlag) > 0 {
+		checkSingleOriginFlags()
+	}
+	if len(routesFlag) > 0 {
+		for i := range routesFlag {
+			routesFlag[i].StripPrefix = stripRoutesFlag
+			originUrl := routesFlag[i].Config.OriginURL
+			checkOriginFlags(originUrl)
+			routesFlag[i].Config = sharedConfig(cacheConfig)
+			routesFlag[i].Config.OriginURL = originUrl
+		}
+		routes, err := alwayscache.CreateRoutes(alwayscache.RoutesConfig{
+			Cache:  cacheConfig.Cache,
+			Routes: routesFlag,
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not set up routes")
+		}
+		for _, route := range routesFlag {
+			log.Info().Msgf("Proxying path '%s' to %s", route.PathPrefix, route.Config.OriginURL.String())
+		}
+		serve(routes)
+		return
+	}
+	if len(virtualHostsFlag) > 0 {
+		hosts := make(map[string]alwayscache.Config, len(virtualHostsFlag))
+		for host, originUrl := range virtualHostsFlag {
+			checkOriginFlags(*originUrl)
+			hostConfig := sharedConfig(cacheConfig)
+			hostConfig.OriginURL = *originUrl
+			hosts[host] = hostConfig
+		}
+		vhosts, err := alwayscache.CreateVirtualHosts(alwayscache.VirtualHostsConfig{
+			Cache: cacheConfig.Cache,
+			Hosts: hosts,
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not set up virtual hosts")
+		}
+		for host, originUrl := range virtualHostsFlag {
+			log.Info().Msgf("Proxying host '%s' to %s", host, originUrl.String())
+		}
+		serve(vhosts)
+		return
 	}
 
 	// get the downstream server address
@@ -98,12 +350,226 @@ func main() {
 	} else {
 		log.Fatal().Msg("Please specify origin")
 	}
+	checkOriginFlags(cacheConfig.OriginURL)
 
 	acache := alwayscache.CreateCache(cacheConfig)
-	log.Info().Msgf("Proxying port %v to %s (with hostname '%s')", portFlag, cacheConfig.OriginURL.String(), cacheConfig.OriginHost)
-	err := http.ListenAndServe(fmt.Sprintf(":%d", portFlag), acache)
+	log.Info().Msgf("Proxying to %s (with hostname '%s')", cacheConfig.OriginURL.String(), cacheConfig.OriginHost)
+	serve(acache)
+}
 
-	if err != nil {
+// closingHandler is an always-cache handler whose background processes are stopped on shutdown.
+type closingHandler interface {
+	http.Handler
+	Close()
+}
+
+// How long requests in progress are waited for on shutdown.
+const shutdownTimeout = 10 * time.Second
+
+// serve serves the handler on the TCP port and the Unix socket, whichever are configured.
+// On SIGINT or SIGTERM, requests in progress are completed and the handler is closed.
+func serve(handler closingHandler) {
+	listeners := make([]net.Listener, 0, 2)
+	if socketFlag != "" {
+		mode, err := strconv.ParseUint(socketModeFlag, 8, 32)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid socket mode")
+		}
+		l, err := alwayscache.ListenUnix(socketFlag, fs.FileMode(mode))
+		if err != nil {
+			log.Fatal().Err(err).Msg("Cannot listen on socket")
+		}
+		listeners = append(listeners, l)
+	}
+	if portFlag != 0 {
+		l, err := net.Listen("tcp", fmt.Sprintf(":%d", portFlag))
+		if err != nil {
+			log.Fatal().Err(err).Msg("Cannot listen on port")
+		}
+		listeners = append(listeners, l)
+	}
+	if len(listeners) == 0 {
+		log.Fatal().Msg("Please specify port or socket")
+	}
+
+	server := &http.Server{Handler: handler}
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		log.Info().Str("address", l.Addr().String()).Msg("Listening")
+		go func(l net.Listener) {
+			errs <- server.Serve(l)
+		}(l)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-errs:
 		panic(err)
+	case sig := <-signals:
+		log.Info().Str("signal", sig.String()).Msg("Shutting down")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Warn().Err(err).Msg("Requests still in progress at shutdown")
+	}
+	handler.Close()
+}
+
+// sharedConfig returns the settings that apply to each origin when serving multiple origins.
+// Settings targeting a single origin, i.e. the origin pool, refresh schedules, pushing and
+// offline mode, are left out.
+func sharedConfig(c alwayscache.Config) alwayscache.Config {
+	return alwayscache.Config{
+		Cache:                 c.Cache,
+		DisableUpdates:        c.DisableUpdates,
+		IdleTimeout:           c.IdleTimeout,
+		IdleGracePeriod:       c.IdleGracePeriod,
+		PurgeIdle:             c.PurgeIdle,
+		UpdateWorkers:         c.UpdateWorkers,
+		RefreshAhead:          c.RefreshAhead,
+		RefreshJitter:         c.RefreshJitter,
+		MaxStaleness:          c.MaxStaleness,
+		MaxDependencyDepth:    c.MaxDependencyDepth,
+		GraphQLPaths:          c.GraphQLPaths,
+		AdaptiveTTL:           c.AdaptiveTTL,
+		OriginFSCacheControl:  c.OriginFSCacheControl,
+		OriginFSWatchInterval: c.OriginFSWatchInterval,
+		FastCGI:               c.FastCGI,
+		OriginTransport:       c.OriginTransport,
+		OriginBudget:          c.OriginBudget,
+	}
+}
+
+// checkSingleOriginFlags exits if flags targeting a single origin are given along with multiple origins.
+func checkSingleOriginFlags() {
+	singleOrigin := map[string]bool{
+		"origin-pool":       originPoolFlag != "",
+		"schedule":          len(schedulesFlag) > 0,
+		"push-token":        pushTokenFlag != "",
+		"offline":           offlineFlag,
+		"offline-threshold": offlineThreshold > 0,
+		"maintenance-page":  maintenanceFlag != "",
+		"host":              hostFlag != "",
+	}
+	for name, set := range singleOrigin {
+		if set {
+			log.Fatal().Str("flag", name).Msg("Flag cannot be used with virtual hosts or routes")
+		}
+	}
+}
+
+// checkOriginFlags exits if flags are set that cannot be used with the scheme of the origin,
+// or if flags required by the scheme are missing.
+func checkOriginFlags(origin url.URL) {
+	if origin.Scheme != "http" && origin.Scheme != "https" && originPoolFlag != "" {
+		log.Fatal().Str("flag", "origin-pool").Str("scheme", origin.Scheme).Msg("Flag can only be used with http and https origins")
+	}
+	if (origin.Scheme == "fcgi" || origin.Scheme == "fcgi+unix") && fcgiRootFlag == "" {
+		log.Fatal().Str("flag", "fcgi-root").Msg("FastCGI origins need the document root of the application")
+	}
+}
+
+// poolAddresses parses the comma-separated origin pool server URLs.
+func poolAddresses(value string) []url.URL {
+	addresses := make([]url.URL, 0)
+	for _, address := range strings.Split(value, ",") {
+		if address = strings.TrimSpace(address); address == "" {
+			continue
+		}
+		addressUrl, err := url.Parse(address)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Could not parse origin pool url")
+		}
+		addresses = append(addresses, *addressUrl)
+	}
+	return addresses
+}
+
+// graphQLPaths splits the comma-separated GraphQL endpoint paths.
+func graphQLPaths(value string) []string {
+	paths := make([]string, 0)
+	for _, path := range strings.Split(value, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// schedules implements flag.Value for repeatable refresh schedules.
+type schedules []alwayscache.RefreshSchedule
+
+func (s *schedules) String() string {
+	return fmt.Sprint(*s)
+}
+
+// Set parses a schedule of the form `<cron expression> <uri>[,<uri>...]`.
+// The cron expression is either a macro such as `@hourly` or five fields.
+func (s *schedules) Set(value string) error {
+	fields := strings.Fields(value)
+	cronFields := 5
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "@") {
+		cronFields = 1
+	}
+	if len(fields) != cronFields+1 {
+		return fmt.Errorf("schedule must be a cron expression followed by comma-separated URIs")
+	}
+	expr := strings.Join(fields[:cronFields], " ")
+	if _, err := cron.Parse(expr); err != nil {
+		return err
+	}
+	*s = append(*s, alwayscache.RefreshSchedule{
+		Cron: expr,
+		URIs: strings.Split(fields[cronFields], ","),
+	})
+	return nil
+}
+
+// virtualHosts implements flag.Value for repeatable virtual host origins.
+type virtualHosts map[string]*url.URL
+
+func (v *virtualHosts) String() string {
+	return fmt.Sprint(*v)
+}
+
+// Set parses a virtual host of the form `<host>=<origin URL>`.
+func (v *virtualHosts) Set(value string) error {
+	host, origin, found := strings.Cut(value, "=")
+	if !found || host == "" {
+		return fmt.Errorf("virtual host must be a host name followed by = and the origin URL")
+	}
+	originUrl, err := url.Parse(origin)
+	if err != nil {
+		return err
+	}
+	if *v == nil {
+		*v = virtualHosts{}
+	}
+	(*v)[host] = originUrl
+	return nil
+}
+
+// routes implements flag.Value for repeatable path prefix routes.
+type routes []alwayscache.Route
+
+func (rs *routes) String() string {
+	return fmt.Sprint(*rs)
+}
+
+// Set parses a route of the form `<path prefix>=<origin URL>`.
+func (rs *routes) Set(value string) error {
+	prefix, origin, found := strings.Cut(value, "=")
+	if !found || !strings.HasPrefix(prefix, "/") {
+		return fmt.Errorf("route must be a path prefix followed by = and the origin URL")
+	}
+	originUrl, err := url.Parse(origin)
+	if err != nil {
+		return err
 	}
+	*rs = append(*rs, alwayscache.Route{
+		PathPrefix: prefix,
+		Config:     alwayscache.Config{OriginURL: *originUrl},
+	})
+	return nil
 }
@@ -0,0 +1,103 @@
+package alwayscache
+
+import (
+	"net/http"
+
+	cacheupdate "github.com/always-cache/always-cache/pkg/cache-update"
+)
+
+// storeDependencies stores the dependencies declared by the origin response
+// for the entry with the given key. Dependencies are stored as GET key prefixes of the URIs.
+// GraphQL responses may also depend on types, see graphQLDependencies.
+func (a *AlwaysCache) storeDependencies(key string, req *http.Request, res *http.Response, body []byte) {
+	uris := cacheupdate.GetDependencies(req, res)
+	dependencies := make([]string, 0, len(uris))
+	for _, uri := range uris {
+		if dependency, err := a.dependencyKey(uri); err == nil {
+			dependencies = append(dependencies, dependency)
+		}
+	}
+	dependencies = append(dependencies, a.graphQLDependencies(req, res, body)...)
+	if err := a.cache.SetDependencies(key, dependencies); err != nil {
+		a.log.Error().Err(err).Str("key", key).Msg("Could not store dependencies")
+	}
+}
+
+// updateDependents updates the stored responses depending on the given URIs.
+// Dependents of updated responses are updated as well, up to the maximum dependency depth.
+// In legacy mode, dependents are purged instead.
+func (a *AlwaysCache) updateDependents(uris []string) {
+	dependencies := make([]string, 0, len(uris))
+	for _, uri := range uris {
+		if dependency, err := a.dependencyKey(uri); err == nil {
+			dependencies = append(dependencies, dependency)
+		}
+	}
+	a.updateDependencies(dependencies)
+}
+
+// updateDependencies updates the stored responses depending on the given dependency identifiers,
+// and transitively their dependents.
+func (a *AlwaysCache) updateDependencies(initial []string) {
+	// dependencies and updated keys are tracked separately, since they may be equal
+	visited := make(map[string]bool)
+	updated := make(map[string]bool)
+	dependencies := make([]string, 0, len(initial))
+	for _, dependency := range initial {
+		if !visited[dependency] {
+			visited[dependency] = true
+			dependencies = append(dependencies, dependency)
+		}
+	}
+
+	for depth := 1; len(dependencies) > 0; depth++ {
+		if depth > a.maxDepsDepth {
+			a.log.Warn().Strs("dependencies", dependencies).Msg("Maximum dependency depth reached, not updating further")
+			return
+		}
+		next := make([]string, 0)
+		for _, dependency := range dependencies {
+			dependents, err := a.cache.Dependents(dependency)
+			if err != nil {
+				a.log.Error().Err(err).Str("dependency", dependency).Msg("Could not get dependents")
+				continue
+			}
+			for _, key := range dependents {
+				if updated[key] {
+					continue
+				}
+				updated[key] = true
+				a.log.Trace().Str("key", key).Str("dependency", dependency).Int("depth", depth).Msg("Updating dependent")
+				if a.updater == nil {
+					a.cache.Purge(key)
+				} else {
+					a.updateEntry(key)
+				}
+				// the dependent is in turn a dependency of other responses
+				req, err := a.keyer.GetRequestFromKey(key)
+				if err != nil {
+					continue
+				}
+				if dependentPrefix, err := a.dependencyKey(req.URL.RequestURI()); err == nil {
+					if visited[dependentPrefix] {
+						a.log.Debug().Str("key", key).Msg("Dependency cycle detected")
+					} else {
+						visited[dependentPrefix] = true
+						next = append(next, dependentPrefix)
+					}
+				}
+			}
+		}
+		dependencies = next
+	}
+}
+
+// dependencyKey returns the identifier used for the given URI in the dependency index,
+// which is the key prefix of a GET request to the URI without any `Cache-Key`.
+func (a *AlwaysCache) dependencyKey(uri string) (string, error) {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return "", err
+	}
+	return a.keyer.GetKeyPrefix(req), nil
+}
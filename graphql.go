@@ -0,0 +1,125 @@
+package alwayscache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	cachekey "github.com/always-cache/always-cache/pkg/cache-key"
+	"github.com/always-cache/always-cache/pkg/graphql"
+	tee "github.com/always-cache/always-cache/pkg/response-writer-tee"
+)
+
+// Prefix of the dependency identifiers of GraphQL types, after the origin prefix.
+const graphQLTypePrefix = "graphql-type:"
+
+type graphQLOperationKey struct{}
+
+// isGraphQL checks if the request is sent to one of the configured GraphQL endpoints.
+func (a *AlwaysCache) isGraphQL(r *http.Request) bool {
+	for _, path := range a.graphQLPaths {
+		if r.URL.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// prepareGraphQL parses the GraphQL request and normalizes it, so that equal operations
+// result in equal cache keys. The normalized form is only used for the cache key, the origin
+// receives the request as sent by the client. The operation type is stored in the request context.
+// It returns false if the response to the request must not be looked up from or stored in the cache,
+// i.e. if the request is not a valid query.
+func (a *AlwaysCache) prepareGraphQL(r *http.Request) (*http.Request, bool) {
+	var body []byte
+	if r.Method == http.MethodPost && r.GetBody != nil {
+		rc, err := r.GetBody()
+		if err != nil {
+			return r, false
+		}
+		body, err = io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return r, false
+		}
+	}
+	req, err := graphql.ParseRequest(r, body)
+	if err != nil {
+		a.log.Debug().Err(err).Str("url", r.URL.String()).Msg("Could not parse GraphQL request")
+		return r, false
+	}
+	typ, err := req.OperationType()
+	if err != nil {
+		a.log.Debug().Err(err).Str("url", r.URL.String()).Msg("Could not determine GraphQL operation")
+		return r, false
+	}
+	r = r.WithContext(context.WithValue(r.Context(), graphQLOperationKey{}, typ))
+	if typ != graphql.Query {
+		return r, false
+	}
+	if req, err = req.Normalize(); err != nil {
+		return r, false
+	}
+
+	keyReq := r.Clone(r.Context())
+	if r.Method == http.MethodGet {
+		keyReq.URL.RawQuery = req.URLQuery()
+		return cachekey.WithKeyRequest(r, keyReq), true
+	}
+	normalized, err := json.Marshal(req)
+	if err != nil {
+		return r, false
+	}
+	keyReq.Header.Set("Content-Type", "application/json")
+	keyReq.Body = io.NopCloser(bytes.NewReader(normalized))
+	keyReq.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(normalized)), nil
+	}
+	keyReq.ContentLength = int64(len(normalized))
+	return cachekey.WithKeyRequest(r, keyReq), true
+}
+
+// isGraphQLOperation checks if the request is a GraphQL operation of the given type.
+func isGraphQLOperation(r *http.Request, typ graphql.OperationType) bool {
+	op, ok := r.Context().Value(graphQLOperationKey{}).(graphql.OperationType)
+	return ok && op == typ
+}
+
+// mustNotStoreGraphQL checks if the response to the request must not be stored
+// because it is the result of a GraphQL mutation or subscription.
+func mustNotStoreGraphQL(r *http.Request) bool {
+	return isGraphQLOperation(r, graphql.Mutation) || isGraphQLOperation(r, graphql.Subscription)
+}
+
+// graphQLDependencies returns the dependency identifiers of the types touched by a GraphQL query.
+func (a *AlwaysCache) graphQLDependencies(r *http.Request, res *http.Response, body []byte) []string {
+	if !a.isGraphQL(r) {
+		return nil
+	}
+	return a.typeDependencies(graphql.ResponseTypes(res.Header, body))
+}
+
+// updateGraphQLTypes updates the stored query responses touching the types modified by a GraphQL mutation.
+func (a *AlwaysCache) updateGraphQLTypes(r *http.Request, rw *tee.ResponseSaver) {
+	if !isGraphQLOperation(r, graphql.Mutation) || rw.StatusCode() >= 400 {
+		return
+	}
+	body, err := storedBody(rw.Response())
+	if err != nil {
+		return
+	}
+	if types := graphql.ResponseTypes(rw.Header(), body); len(types) > 0 {
+		a.log.Debug().Strs("types", types).Msg("Updating GraphQL queries touching mutated types")
+		a.updateDependencies(a.typeDependencies(types))
+	}
+}
+
+func (a *AlwaysCache) typeDependencies(types []string) []string {
+	dependencies := make([]string, len(types))
+	for i, typ := range types {
+		dependencies[i] = a.keyer.OriginPrefix + graphQLTypePrefix + typ
+	}
+	return dependencies
+}
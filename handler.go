@@ -0,0 +1,86 @@
+package alwayscache
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	tee "github.com/always-cache/always-cache/pkg/response-writer-tee"
+	static "github.com/always-cache/always-cache/pkg/static-origin"
+)
+
+// handlerTransport is an http.RoundTripper serving requests with an in-process handler
+// instead of sending them over the network.
+// The response is buffered in memory until the handler returns, so the handler must not stream
+// long-lived or very large responses (e.g. server-sent events): the client receives nothing
+// before the handler is done.
+type handlerTransport struct {
+	handler http.Handler
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+// The outgoing request is turned into a server request for the handler,
+// and a panicking handler results in an error like a failed connection would.
+func (t handlerTransport) RoundTrip(req *http.Request) (res *http.Response, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			res, err = nil, fmt.Errorf("Origin handler panicked: %v", recovered)
+		}
+	}()
+	rw := tee.NewResponseSaver(nil)
+	// like a server, add the Date header unless the handler sets it
+	rw.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	t.handler.ServeHTTP(rw, serverRequest(req))
+	if rw.StatusCode() == 0 {
+		rw.WriteHeader(http.StatusOK)
+	}
+	return http.ReadResponse(bufio.NewReader(bytes.NewReader(rw.Response())), req)
+}
+
+// Remote address of requests initiated by the cache itself, which has no client.
+const cacheRemoteAddr = "127.0.0.1:0"
+
+// serverRequest returns the outgoing request as it would be received by a server.
+// The remote address is that of the client request, or the loopback address for
+// requests initiated by the cache (updates, warming, schedules).
+func serverRequest(req *http.Request) *http.Request {
+	in := req.Clone(req.Context())
+	in.RequestURI = req.URL.RequestURI()
+	in.URL = &url.URL{
+		Path:     req.URL.Path,
+		RawPath:  req.URL.RawPath,
+		RawQuery: req.URL.RawQuery,
+	}
+	if in.Host == "" {
+		in.Host = req.URL.Host
+	}
+	if in.Host == "" {
+		in.Host = "localhost"
+	}
+	if in.RemoteAddr == "" {
+		in.RemoteAddr = cacheRemoteAddr
+	}
+	if in.Body == nil {
+		in.Body = http.NoBody
+	}
+	return in
+}
+
+// updateFiles updates the stored responses of the changed files of the origin file system,
+// and the responses depending on them. With updates disabled, the responses are purged instead.
+func (a *AlwaysCache) updateFiles(names []string) {
+	uris := make([]string, 0, len(names))
+	for _, name := range names {
+		uris = append(uris, static.URIs(name)...)
+	}
+	a.log.Debug().Strs("files", names).Msg("Origin files changed, updating")
+	if a.updater == nil {
+		a.invalidateUris(uris)
+	} else {
+		a.revalidateUris(uris)
+	}
+	a.updateDependents(uris)
+}
@@ -0,0 +1,54 @@
+package alwayscache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// idlePolicy decides whether expiring entries are worth updating,
+// based on when they were last requested.
+type idlePolicy struct {
+	// Entries not requested within this duration are idle. Zero disables the policy.
+	timeout time.Duration
+	// Extra time given to entries that have never been requested.
+	grace time.Duration
+	// Purge idle entries instead of leaving them to expire.
+	purge bool
+	// Number of updates skipped because of the policy.
+	skipped *atomic.Int64
+}
+
+// isIdle checks whether the entry for the given key has not been requested recently enough
+// to be kept updated. Entries without any recorded statistics are never idle.
+func (a *AlwaysCache) isIdle(key string) bool {
+	if a.idle.timeout == 0 {
+		return false
+	}
+	stats, found, err := a.cache.KeyStats(key)
+	if err != nil {
+		a.log.Error().Err(err).Str("key", key).Msg("Could not get entry stats")
+		return false
+	} else if !found {
+		return false
+	}
+	if stats.LastAccess.IsZero() {
+		return time.Since(stats.CreatedAt) > a.idle.timeout+a.idle.grace
+	}
+	return time.Since(stats.LastAccess) > a.idle.timeout
+}
+
+// skipIdle removes an idle entry from updating, either by purging it
+// or by clearing its expiration so that it is left to expire.
+func (a *AlwaysCache) skipIdle(key string) {
+	skipped := a.idle.skipped.Add(1)
+	a.log.Info().
+		Str("key", key).
+		Bool("purge", a.idle.purge).
+		Int64("skipped", skipped).
+		Msg("Skipping update of idle entry")
+	if a.idle.purge {
+		a.cache.Purge(key)
+	} else if err := a.cache.SetExpires(key, time.Time{}); err != nil {
+		a.log.Error().Err(err).Str("key", key).Msg("Could not clear expiration of idle entry")
+	}
+}
@@ -0,0 +1,139 @@
+package alwayscache
+
+import (
+	"time"
+
+	"github.com/always-cache/always-cache/cache"
+)
+
+// Number of times a delayed update is attempted before giving up.
+const maxJobAttempts = 5
+
+// How many delays a job can be pushed back from its creation by coalescing, so that
+// keys receiving delayed updates faster than their delay are still updated.
+const maxJobDelays = 2
+
+// queueUpdate stores a delayed update of the given key as a job and schedules it.
+// Updates of the same key are coalesced into a single job, which is run at the latest due time,
+// but no later than maxJobDelays delays after the job was created.
+func (a *AlwaysCache) queueUpdate(key string, delay time.Duration, source string) {
+	now := time.Now()
+	job := cache.Job{
+		Key:       key,
+		Due:       now.Add(delay),
+		Source:    source,
+		CreatedAt: now,
+	}
+	if existing, found := a.getJob(key); found {
+		a.log.Debug().Str("key", key).Str("source", source).Msg("Coalescing delayed update with pending one")
+		job.CreatedAt = existing.CreatedAt
+		if limit := existing.CreatedAt.Add(maxJobDelays * delay); job.Due.After(limit) {
+			job.Due = limit
+		}
+		if existing.Due.After(job.Due) {
+			job.Due = existing.Due
+		}
+	}
+	if err := a.cache.PutJob(job); err != nil {
+		a.log.Error().Err(err).Str("key", key).Msg("Could not store delayed update")
+	}
+	a.jobs.ScheduleAt(key, job.Due)
+}
+
+// restoreJobs schedules the delayed updates stored before the process (re)started.
+func (a *AlwaysCache) restoreJobs() {
+	jobs, err := a.cache.Jobs(a.keyer.OriginPrefix)
+	if err != nil {
+		a.log.Error().Err(err).Msg("Could not restore delayed updates")
+		return
+	}
+	if len(jobs) > 0 {
+		a.log.Info().Int("jobs", len(jobs)).Msg("Restoring delayed updates")
+	}
+	for _, job := range jobs {
+		a.jobs.ScheduleAt(job.Key, job.Due)
+	}
+}
+
+// runJob is called by the job scheduler when a delayed update is due.
+// The update is done like a scheduled one. Transient failures are retried with backoff,
+// up to the maximum number of attempts, after which the job is dropped and the stored response kept.
+func (a *AlwaysCache) runJob(key string) {
+	job, found := a.getJob(key)
+	if !found {
+		return
+	}
+	req, err := a.requestFromKey(key)
+	if err != nil {
+		a.log.Error().Err(err).Str("key", key).Msg("Could not create request for delayed update")
+		a.deleteJob(job)
+		return
+	}
+	// the origin is not contacted while offline, the job waits until it is back
+	if a.offline.active() {
+		job.Due = time.Now().Add(a.offline.config.ProbeInterval)
+		a.rescheduleJob(job)
+		return
+	}
+	rw := a.refreshEntry(key, req)
+	if isTransientFailure(rw.StatusCode()) {
+		job.Attempts++
+		if job.Attempts >= maxJobAttempts {
+			a.log.Warn().
+				Str("key", key).
+				Int("status", rw.StatusCode()).
+				Int("attempts", job.Attempts).
+				Msg("Could not run delayed update, giving up")
+			a.deleteJob(job)
+			return
+		}
+		job.Due = time.Now().Add(retryDelay(job.Attempts, rw.Header().Get("Retry-After")))
+		a.log.Warn().
+			Str("key", key).
+			Int("status", rw.StatusCode()).
+			Int("attempt", job.Attempts).
+			Msg("Could not run delayed update, retrying")
+		a.rescheduleJob(job)
+		return
+	}
+	a.deleteJob(job)
+	a.updateDependents([]string{req.URL.RequestURI()})
+}
+
+// rescheduleJob stores the changed job and schedules it at its new due time.
+func (a *AlwaysCache) rescheduleJob(job cache.Job) {
+	if err := a.cache.PutJob(job); err != nil {
+		a.log.Error().Err(err).Str("key", job.Key).Msg("Could not store delayed update")
+	}
+	a.jobs.ScheduleAt(job.Key, job.Due)
+}
+
+// deleteJob deletes the job, unless it has been coalesced with a new update while running.
+func (a *AlwaysCache) deleteJob(job cache.Job) {
+	if current, found := a.getJob(job.Key); found && current.Due.After(job.Due) {
+		return
+	}
+	if err := a.cache.DeleteJob(job.Key); err != nil {
+		a.log.Error().Err(err).Str("key", job.Key).Msg("Could not delete delayed update")
+	}
+}
+
+// getJob returns the pending job with exactly the given key.
+func (a *AlwaysCache) getJob(key string) (cache.Job, bool) {
+	jobs, err := a.cache.Jobs(key)
+	if err != nil {
+		a.log.Error().Err(err).Str("key", key).Msg("Could not retrieve delayed updates")
+		return cache.Job{}, false
+	}
+	for _, job := range jobs {
+		if job.Key == key {
+			return job, true
+		}
+	}
+	return cache.Job{}, false
+}
+
+// PendingUpdates returns the delayed updates waiting to be run, ordered by due time.
+func (a *AlwaysCache) PendingUpdates() ([]cache.Job, error) {
+	return a.cache.Jobs(a.keyer.OriginPrefix)
+}
@@ -0,0 +1,186 @@
+package alwayscache
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/always-cache/always-cache/cache"
+	tee "github.com/always-cache/always-cache/pkg/response-writer-tee"
+	"github.com/always-cache/always-cache/rfc9111"
+	"github.com/always-cache/always-cache/rfc9211"
+)
+
+// Cache-Status detail of responses served while the origin is unavailable.
+const offlineDetail = "offline"
+
+const defaultMaintenancePage = "The site is temporarily unavailable. Please try again later.\n"
+
+// OfflineMode configures serving stored responses while the origin is unavailable.
+type OfflineMode struct {
+	// Number of consecutive failed origin requests (connection errors and 502, 503 and 504 responses)
+	// after which the origin is considered unavailable. Zero disables detection,
+	// in which case offline mode can only be forced.
+	FailureThreshold int
+	// Start in forced offline mode, see SetOffline.
+	Forced bool
+	// Path requested from the origin to check if it is available again. Defaults to `/`.
+	ProbePath string
+	// Interval of checks while the origin is unavailable. Defaults to 10 seconds.
+	ProbeInterval time.Duration
+	// Body of the 503 response to requests without a stored response while offline.
+	// A plain text message is used if empty.
+	MaintenancePage []byte
+	// Content type of the maintenance page. Defaults to `text/html; charset=utf-8`
+	// if a maintenance page is set.
+	MaintenanceContentType string
+}
+
+// offlineState is the circuit breaker deciding whether the origin is contacted.
+type offlineState struct {
+	config   OfflineMode
+	mutex    sync.Mutex
+	failures int
+	detected bool
+	forced   bool
+}
+
+func newOfflineState(config OfflineMode) *offlineState {
+	if config.ProbePath == "" {
+		config.ProbePath = "/"
+	}
+	if config.ProbeInterval == 0 {
+		config.ProbeInterval = 10 * time.Second
+	}
+	if config.MaintenanceContentType == "" {
+		if len(config.MaintenancePage) > 0 {
+			config.MaintenanceContentType = "text/html; charset=utf-8"
+		} else {
+			config.MaintenanceContentType = "text/plain; charset=utf-8"
+		}
+	}
+	if len(config.MaintenancePage) == 0 {
+		config.MaintenancePage = []byte(defaultMaintenancePage)
+	}
+	return &offlineState{config: config, forced: config.Forced}
+}
+
+func (o *offlineState) active() bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.forced || o.detected
+}
+
+// enabled checks if offline mode is in use, i.e. failures are detected or offline mode is forced.
+func (o *offlineState) enabled() bool {
+	return o.config.FailureThreshold > 0 || o.active()
+}
+
+// IsOffline returns true if stored responses are served without contacting the origin,
+// either because the origin is unavailable or because offline mode is forced.
+func (a *AlwaysCache) IsOffline() bool {
+	return a.offline.active()
+}
+
+// SetOffline forces offline mode on or off. When turned off, the origin is contacted again,
+// unless it has been detected to be unavailable.
+func (a *AlwaysCache) SetOffline(forced bool) {
+	a.offline.mutex.Lock()
+	a.offline.forced = forced
+	a.offline.mutex.Unlock()
+	a.log.Info().Bool("forced", forced).Msg("Offline mode set manually")
+}
+
+// recordOriginStatus counts consecutive origin failures, switching to offline mode
+// when the failure threshold is reached.
+func (a *AlwaysCache) recordOriginStatus(status int) {
+	o := a.offline
+	if o.config.FailureThreshold == 0 {
+		return
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if !originUnavailable(status) {
+		o.failures = 0
+		return
+	}
+	o.failures++
+	if o.failures >= o.config.FailureThreshold && !o.detected {
+		o.detected = true
+		a.log.Warn().Int("failures", o.failures).Msg("Origin unavailable, serving stored responses")
+		go a.probeOrigin()
+	}
+}
+
+// probeOrigin checks periodically if the origin is available again, resuming normal operation once it is.
+func (a *AlwaysCache) probeOrigin() {
+	o := a.offline
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-time.After(o.config.ProbeInterval):
+		}
+		req, err := http.NewRequest(http.MethodGet, o.config.ProbePath, nil)
+		if err != nil {
+			a.log.Error().Err(err).Msg("Could not create origin probe request")
+			return
+		}
+		rw := tee.NewResponseSaver(nil)
+		a.forward(rw, req)
+		if !originUnavailable(rw.StatusCode()) {
+			o.mutex.Lock()
+			o.detected = false
+			o.failures = 0
+			o.mutex.Unlock()
+			a.log.Info().Int("status", rw.StatusCode()).Msg("Origin available again, resuming normal operation")
+			return
+		}
+	}
+}
+
+// serveOffline sends the stored response matching the request regardless of its freshness,
+// or the maintenance page if there is none.
+func (a *AlwaysCache) serveOffline(w http.ResponseWriter, r *http.Request, entries []cache.CacheEntry) {
+	for _, ce := range entries {
+		res := a.createStoredResponse(ce)
+		if res == nil {
+			continue
+		}
+		if !rfc9111.VaryHeadersMatch(r, res) {
+			res.Body.Close()
+			continue
+		}
+		a.cache.RecordHit(ce.Key)
+		cs := rfc9211.CacheStatus{}
+		cs.Hit()
+		cs.Detail = offlineDetail
+		a.sendStoredResponse(w, r, res, ce, cs)
+		return
+	}
+	a.sendMaintenancePage(w, r)
+}
+
+// sendMaintenancePage responds to a request that cannot be served while offline.
+func (a *AlwaysCache) sendMaintenancePage(w http.ResponseWriter, r *http.Request) {
+	o := a.offline
+	cs := rfc9211.CacheStatus{}
+	cs.Forward(rfc9211.FwdReasonUriMiss)
+	cs.Detail = offlineDetail
+	w.Header().Set("Content-Type", o.config.MaintenanceContentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", strconv.Itoa(int(o.config.ProbeInterval.Seconds())))
+	w.Header().Add("Cache-Status", cs.String())
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(o.config.MaintenancePage)
+	a.logRequest(r, cs)
+}
+
+// originUnavailable checks if the origin response status means that the origin could not be reached
+// or is not able to serve requests at all.
+func originUnavailable(status int) bool {
+	return status == http.StatusBadGateway ||
+		status == http.StatusServiceUnavailable ||
+		status == http.StatusGatewayTimeout
+}
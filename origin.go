@@ -0,0 +1,74 @@
+package alwayscache
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	budget "github.com/always-cache/always-cache/pkg/origin-budget"
+	pool "github.com/always-cache/always-cache/pkg/origin-pool"
+	tee "github.com/always-cache/always-cache/pkg/response-writer-tee"
+)
+
+// forward sends a client-driven request to the origin.
+// It is never delayed by the origin budget, but takes up a slot in it.
+func (a *AlwaysCache) forward(rw *tee.ResponseSaver, r *http.Request) {
+	a.roundTrip(a.budget.Foreground(), rw, r)
+}
+
+// roundTrip sends the request to the origin and reports the result to the origin budget.
+// Changes in the slowdown of background fetches are logged.
+func (a *AlwaysCache) roundTrip(done budget.Done, rw *tee.ResponseSaver, r *http.Request) {
+	factor := a.budget.Stats().Factor
+	start := time.Now()
+	func() {
+		// the reverse proxy panics if the client goes away, the slot must be released regardless
+		defer func() { done(rw.StatusCode(), time.Since(start)) }()
+		a.reverseproxy.ServeHTTP(rw, r)
+	}()
+	a.recordOriginStatus(rw.StatusCode())
+
+	if stats := a.budget.Stats(); stats.Factor > factor {
+		a.log.Warn().
+			Int("factor", stats.Factor).
+			Dur("latency", stats.Latency).
+			Float64("errorRate", stats.ErrorRate).
+			Msg("Origin overloaded, slowing down background fetches")
+	} else if stats.Factor < factor {
+		a.log.Info().Int("factor", stats.Factor).Msg("Origin recovering, speeding up background fetches")
+	}
+}
+
+// OriginStats returns the current load on the origin as seen by the origin budget.
+func (a *AlwaysCache) OriginStats() budget.Stats {
+	return a.budget.Stats()
+}
+
+// OriginPoolStats returns the state of the origin pool members, if an origin pool is configured.
+func (a *AlwaysCache) OriginPoolStats() []pool.MemberStats {
+	if a.pool == nil {
+		return nil
+	}
+	return a.pool.Stats()
+}
+
+// logPoolChange logs origin pool members becoming available or unavailable.
+func (a *AlwaysCache) logPoolChange(member pool.MemberStats) {
+	if member.Available {
+		a.log.Info().Str("member", member.Address).Msg("Origin pool member available")
+	} else {
+		a.log.Warn().
+			Str("member", member.Address).
+			Bool("healthy", member.Healthy).
+			Int("failures", member.Failures).
+			Msg("Origin pool member unavailable")
+	}
+}
+
+// hostname returns the host without port.
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
@@ -0,0 +1,61 @@
+package cachekey
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// bodyDigest returns a digest of the canonicalized request body,
+// so that semantically equal bodies have equal digests.
+// It returns an empty string if the request has no body, or if the body cannot be read again
+// (i.e. `GetBody` is not set).
+func bodyDigest(r *http.Request) string {
+	if r.GetBody == nil {
+		return ""
+	}
+	rc, err := r.GetBody()
+	if err != nil {
+		return ""
+	}
+	defer rc.Close()
+	body, err := io.ReadAll(rc)
+	if err != nil || len(body) == 0 {
+		return ""
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	h := sha256.New()
+	h.Write([]byte(mediaType + "\n"))
+	h.Write(canonicalBody(mediaType, body))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// canonicalBody returns the canonical form of JSON and form bodies.
+// JSON objects are sorted by key and whitespace is removed,
+// form parameters are sorted by name (keeping the order of values of the same parameter).
+// Other bodies, and bodies that cannot be parsed, are returned as is.
+func canonicalBody(mediaType string, body []byte) []byte {
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		var v interface{}
+		d := json.NewDecoder(bytes.NewReader(body))
+		d.UseNumber()
+		if err := d.Decode(&v); err != nil {
+			return body
+		}
+		if canonical, err := json.Marshal(v); err == nil {
+			return canonical
+		}
+	case mediaType == "application/x-www-form-urlencoded":
+		if values, err := url.ParseQuery(string(body)); err == nil {
+			return []byte(values.Encode())
+		}
+	}
+	return body
+}
@@ -1,6 +1,7 @@
 package cachekey
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"strings"
@@ -14,8 +15,19 @@ const (
 	originSeparator = ":"
 	methodSeparator = ":"
 	varySeparator   = "\t"
+	// separates the URI from the body digest, `#` cannot be part of a request URI
+	bodySeparator = "#"
 )
 
+type keyRequestKey struct{}
+
+// WithKeyRequest returns the request with another request attached, which is used instead of it
+// for deriving the cache key prefix, e.g. a normalized form of the request.
+// The request itself is sent to the origin as is.
+func WithKeyRequest(r *http.Request, keyRequest *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), keyRequestKey{}, keyRequest))
+}
+
 type CacheKeyer struct {
 	// Unique identifier for the origin.
 	// Usually this should be the origin - well - origin.
@@ -40,14 +52,32 @@ func (c CacheKeyer) MethodPrefix(method string) string {
 // getKeyPrefix returns the cache key for a request without the vary headers (i.e. a key prefix).
 // The returned key is suitable for finding all stored response variants for a porticular request.
 // If the request has a `Cache-Key` header, that value is included in the key prefix.
+// For POST requests with a body that can be read again (`GetBody`), a digest of the body is included.
+// If a key request is attached to the request (see WithKeyRequest), the prefix is derived from it.
 func (c CacheKeyer) GetKeyPrefix(r *http.Request) string {
-	key := c.OriginId + originSeparator + r.Method + methodSeparator + r.URL.RequestURI() + varySeparator
+	if keyRequest, ok := r.Context().Value(keyRequestKey{}).(*http.Request); ok {
+		r = keyRequest
+	}
+	key := c.OriginId + originSeparator + r.Method + methodSeparator + r.URL.RequestURI()
+	if r.Method == http.MethodPost {
+		if digest := bodyDigest(r); digest != "" {
+			key += bodySeparator + digest
+		}
+	}
+	key += varySeparator
 	if ck := r.Header.Get("Cache-Key"); ck != "" {
 		key += ck
 	}
 	return key
 }
 
+// URIPrefixes returns the key prefixes for all stored responses to requests with the given method and URI,
+// regardless of `Cache-Key`, Vary headers and request body.
+func (c CacheKeyer) URIPrefixes(method, uri string) []string {
+	prefix := c.MethodPrefix(method) + uri
+	return []string{prefix + varySeparator, prefix + bodySeparator}
+}
+
 // addVaryKeys returns the full cache key (including vary headers) based on a previously generated
 // cache key prefix and the request and response involved.
 func (c CacheKeyer) AddVaryKeys(prefix string, req *http.Request, res *http.Response) string {
@@ -68,7 +98,7 @@ func (c CacheKeyer) GetRequestFromKey(key string) (*http.Request, error) {
 		return nil, fmt.Errorf("Key and origin do not match")
 	}
 	keyNoOrigin := strings.TrimPrefix(key, c.OriginPrefix)
-	keyNoVary, _, found := strings.Cut(keyNoOrigin, varySeparator)
+	keyNoVary, varyPart, found := strings.Cut(keyNoOrigin, varySeparator)
 	if !found {
 		return nil, fmt.Errorf("Malformed key: %s", key)
 	}
@@ -76,11 +106,17 @@ func (c CacheKeyer) GetRequestFromKey(key string) (*http.Request, error) {
 	if !found {
 		return nil, fmt.Errorf("Malformed key: %s", key)
 	}
+	// the body cannot be restored from its digest
+	uri, _, _ = strings.Cut(uri, bodySeparator)
 	req, err := http.NewRequest(method, uri, nil)
 	if err != nil {
 		return req, err
 	}
 	req.Header = c.GetVaryHeaders(key)
+	// the `Cache-Key` header value is between the vary separator and the vary headers
+	if ck, _, _ := strings.Cut(varyPart, "\n"); ck != "" {
+		req.Header.Set("Cache-Key", ck)
+	}
 	return req, nil
 }
 
@@ -26,3 +26,73 @@ func TestOriginPrefixIncludesOrigin(t *testing.T) {
 		t.Fatalf("OriginPrefix is %s", keygen.OriginPrefix)
 	}
 }
+
+func TestRequestFromKeyWithCacheKeyAndVary(t *testing.T) {
+	keygen := NewCacheKeyer("this-is-the-origin")
+	r, _ := http.NewRequest("GET", "http://dev.localhost/page?q=1", nil)
+	r.Header.Set("Cache-Key", "mobile")
+	r.Header.Set("Accept-Language", "fi")
+	res := &http.Response{Header: http.Header{"Vary": []string{"Accept-Language"}}}
+	key := keygen.AddVaryKeys(keygen.GetKeyPrefix(r), r, res)
+
+	req, err := keygen.GetRequestFromKey(key)
+	if err != nil {
+		t.Fatalf("%s: %s", key, err)
+	}
+	if url := req.URL.String(); url != "/page?q=1" {
+		t.Fatalf("Created request url for key %s is %s", key, url)
+	}
+	if ck := req.Header.Get("Cache-Key"); ck != "mobile" {
+		t.Fatalf("Cache-Key is %s", ck)
+	}
+	if al := req.Header.Get("Accept-Language"); al != "fi" {
+		t.Fatalf("Accept-Language is %s", al)
+	}
+	if again := keygen.AddVaryKeys(keygen.GetKeyPrefix(req), req, res); again != key {
+		t.Fatalf("Key from created request is %q, expected %q", again, key)
+	}
+}
+
+func postRequest(contentType, body string) *http.Request {
+	r, _ := http.NewRequest("POST", "http://dev.localhost/search", strings.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	return r
+}
+
+func TestPostKeyIncludesCanonicalBody(t *testing.T) {
+	keygen := NewCacheKeyer("this-is-the-origin")
+	equal := [][2]*http.Request{
+		{postRequest("application/json", `{"a": 1, "b": [1, 2]}`), postRequest("application/json; charset=utf-8", `{"b":[1,2],"a":1}`)},
+		{postRequest("application/x-www-form-urlencoded", "a=1&b=2&b=3"), postRequest("application/x-www-form-urlencoded", "b=2&a=1&b=3")},
+	}
+	for _, pair := range equal {
+		if k1, k2 := keygen.GetKeyPrefix(pair[0]), keygen.GetKeyPrefix(pair[1]); k1 != k2 {
+			t.Fatalf("Keys %q and %q differ", k1, k2)
+		}
+	}
+	different := [][2]*http.Request{
+		{postRequest("application/json", `{"a": 1}`), postRequest("application/json", `{"a": 2}`)},
+		{postRequest("application/x-www-form-urlencoded", "b=2&b=3"), postRequest("application/x-www-form-urlencoded", "b=3&b=2")},
+		{postRequest("text/plain", "a"), postRequest("text/plain", "b")},
+	}
+	for _, pair := range different {
+		if k1, k2 := keygen.GetKeyPrefix(pair[0]), keygen.GetKeyPrefix(pair[1]); k1 == k2 {
+			t.Fatalf("Keys for different bodies are equal: %q", k1)
+		}
+	}
+
+	key := keygen.GetKeyPrefix(postRequest("application/json", `{}`))
+	req, err := keygen.GetRequestFromKey(key)
+	if err != nil || req.URL.String() != "/search" {
+		t.Fatalf("Created request for key %s is %v (%v)", key, req, err)
+	}
+}
+
+func TestKeyRequestIsUsedForKey(t *testing.T) {
+	keygen := NewCacheKeyer("origin")
+	r, _ := http.NewRequest("GET", "/graphql?query=%7B+a+%7D", nil)
+	keyRequest, _ := http.NewRequest("GET", "/graphql?query=%7Ba%7D", nil)
+	if key := keygen.GetKeyPrefix(WithKeyRequest(r, keyRequest)); key != "origin:GET:/graphql?query=%7Ba%7D\t" {
+		t.Fatalf("Key is %s", key)
+	}
+}
@@ -0,0 +1,24 @@
+package cacheupdate
+
+import (
+	"net/http"
+
+	"github.com/always-cache/always-cache/rfc9111"
+)
+
+// GetDependencies gets the URIs that the response declares it depends on,
+// via the `Cache-Depends` header. When any of these is updated, the response should be updated too.
+// The request is used in order to resolve potentially relative URIs.
+// Absolute URLs pointing to other hosts than the one of the request are ignored.
+func GetDependencies(req *http.Request, res *http.Response) []string {
+	dependencies := make([]string, 0)
+	for _, dependency := range rfc9111.GetListHeader(res.Header, "Cache-Depends") {
+		if dependency == "" {
+			continue
+		}
+		if u := getURL(req, dependency); u != nil && sameHost(req, u) {
+			dependencies = append(dependencies, u.RequestURI())
+		}
+	}
+	return dependencies
+}
@@ -3,6 +3,7 @@ package cacheupdate
 import (
 	"net/http"
 	"net/url"
+	"path"
 	"regexp"
 	"strconv"
 	"strings"
@@ -11,42 +12,134 @@ import (
 	"github.com/always-cache/always-cache/rfc9111"
 )
 
+// Mode is the action to take for the targeted responses.
+type Mode string
+
+const (
+	// Fetch a new response from the origin and store it.
+	ModeUpdate Mode = "update"
+	// Remove the stored responses.
+	ModePurge Mode = "purge"
+)
+
+// Header names accepted for cache updates.
+// `Cache-Fetch` is accepted as an alias, since it is the name used in the documentation.
+var headerNames = []string{"Cache-Update", "Cache-Fetch"}
+
+// Token referring to the URI of the current request.
+const selfToken = "self"
+
 // CacheUpdate represents a single `Cache-Update` entry.
 type CacheUpdate struct {
-	// Fully resolved relative path to the resource.
-	// Equivalent to `url.URL.Path`.
-	Path string
+	// Fully resolved request URI (path and query) of the resource.
+	// Equivalent to `url.URL.RequestURI()`.
+	// If Pattern is true, this is a path prefix or glob pattern instead.
+	URI string
+	// The URI is a pattern to match against the URIs of stored responses.
+	// A pattern ending with `*` (and no other wildcards) matches all URIs with that prefix,
+	// other patterns follow `path.Match` syntax. The path and the query are matched separately,
+	// and a pattern without a query matches URIs with any query. Note that `?` always starts the query.
+	Pattern bool
+	// What to do with the targeted responses.
+	Mode Mode
 	// Update delay, i.e. delay update by this duration.
 	Delay time.Duration
 }
 
+// Matches checks whether the update targets the given request URI.
+func (cu CacheUpdate) Matches(uri string) bool {
+	if !cu.Pattern {
+		return uri == cu.URI
+	}
+	patternPath, patternQuery, hasQuery := strings.Cut(cu.URI, "?")
+	uriPath, uriQuery, _ := strings.Cut(uri, "?")
+	if prefix := strings.TrimSuffix(cu.URI, "*"); !strings.ContainsAny(prefix, "*[?") {
+		return strings.HasPrefix(uri, prefix)
+	}
+	if matched, err := path.Match(patternPath, uriPath); err != nil || !matched {
+		return false
+	}
+	if !hasQuery {
+		return true
+	}
+	// within the query, `?` is not a wildcard
+	matched, err := path.Match(strings.ReplaceAll(patternQuery, "?", `\?`), uriQuery)
+	return err == nil && matched
+}
+
+// Prefix returns the literal beginning of the URI, i.e. the part before any wildcards.
+// All URIs matched by the update start with it.
+func (cu CacheUpdate) Prefix() string {
+	if !cu.Pattern {
+		return cu.URI
+	}
+	if i := strings.IndexAny(cu.URI, `*[?\`); i >= 0 {
+		return cu.URI[:i]
+	}
+	return cu.URI
+}
+
 // GetCacheUpdates gets the updates specified by the response.
 // The incoming request is used in order to resolve potentially relative update paths.
+// Absolute URLs pointing to other hosts than the one of the request are ignored.
 func GetCacheUpdates(req *http.Request, res *http.Response) []CacheUpdate {
 	if !rfc9111.UnsafeRequest(req) {
 		return nil
 	}
 	updates := make([]CacheUpdate, 0)
-	for _, update := range res.Header.Values("Cache-Update") {
-		cu := CacheUpdate{}
-		// path is the first element
-		path := strings.Split(update, ";")[0]
-		cu.Path = getURL(res.Request, path).Path
-		cu.Delay = getDelay(update)
-
-		updates = append(updates, cu)
+	for _, name := range headerNames {
+		for _, update := range res.Header.Values(name) {
+			u := getURL(res.Request, update)
+			if u == nil || !sameHost(res.Request, u) {
+				continue
+			}
+			cu := CacheUpdate{
+				URI:     u.RequestURI(),
+				Pattern: strings.ContainsAny(u.Path, "*["),
+				Mode:    getMode(update),
+				Delay:   getDelay(update),
+			}
+			updates = append(updates, cu)
+		}
 	}
 	return updates
 }
 
 // getURL returns the URL to update the cache for from the `Cache-Update` header parameter.
 // The URL is the first parameter in the header value (separated by a semicolon).
+// It may be relative to the request URL, and the `self` token refers to the request URL.
+// It returns nil if the URL cannot be parsed.
 func getURL(r *http.Request, update string) *url.URL {
-	possiblyRelativeURL := update
+	possiblyRelativeURL := strings.TrimSpace(update)
 	if i := strings.Index(update, ";"); i != -1 {
-		possiblyRelativeURL = update[:i]
+		possiblyRelativeURL = strings.TrimSpace(update[:i])
+	}
+	if possiblyRelativeURL == selfToken {
+		return r.URL
+	}
+	ref, err := url.Parse(possiblyRelativeURL)
+	if err != nil {
+		return nil
+	}
+	return r.URL.ResolveReference(ref)
+}
+
+// sameHost checks that an absolute update URL points to the host of the request.
+func sameHost(r *http.Request, u *url.URL) bool {
+	if u.Host == "" || u.Host == r.URL.Host {
+		return true
+	}
+	return r.Host != "" && u.Host == r.Host
+}
+
+// getMode returns the mode from the `Cache-Update` header parameter.
+// The mode directive syntax is `mode=update` or `mode=purge`.
+// If no mode directive is found, it returns ModeUpdate.
+func getMode(update string) Mode {
+	if matches := regexp.MustCompile(`(?i)\bmode=(update|purge)\b`).FindStringSubmatch(update); matches != nil {
+		return Mode(strings.ToLower(matches[1]))
 	}
-	return r.URL.ResolveReference(&url.URL{Path: possiblyRelativeURL})
+	return ModeUpdate
 }
 
 // getDelay returns the delay to wait before updating the cache for from the `Cache-Update` header parameter.
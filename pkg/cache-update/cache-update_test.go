@@ -0,0 +1,84 @@
+package cacheupdate
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func getUpdates(t *testing.T, values ...string) []CacheUpdate {
+	req, _ := http.NewRequest("POST", "/products/42?edit=1", nil)
+	req.Host = "example.com"
+	res := &http.Response{Header: http.Header{}, Request: req}
+	for _, v := range values {
+		res.Header.Add("Cache-Update", v)
+	}
+	return GetCacheUpdates(req, res)
+}
+
+func TestQueryIsKept(t *testing.T) {
+	updates := getUpdates(t, "/search?q=shoes; delay=5")
+	if len(updates) != 1 || updates[0].URI != "/search?q=shoes" || updates[0].Delay != 5*time.Second {
+		t.Fatalf("Updates are %+v", updates)
+	}
+}
+
+func TestSelfAndRelative(t *testing.T) {
+	updates := getUpdates(t, "self", "../list")
+	if len(updates) != 2 || updates[0].URI != "/products/42?edit=1" || updates[1].URI != "/list" {
+		t.Fatalf("Updates are %+v", updates)
+	}
+}
+
+func TestAbsoluteURL(t *testing.T) {
+	updates := getUpdates(t, "https://example.com/a?b=c", "https://other.com/a")
+	if len(updates) != 1 || updates[0].URI != "/a?b=c" {
+		t.Fatalf("Updates are %+v", updates)
+	}
+}
+
+func TestPatternsAndMode(t *testing.T) {
+	updates := getUpdates(t, "/products/*; mode=purge", "/products/[0-9]")
+	if len(updates) != 2 || !updates[0].Pattern || updates[0].Mode != ModePurge || updates[1].Mode != ModeUpdate {
+		t.Fatalf("Updates are %+v", updates)
+	}
+	if !updates[0].Matches("/products/42/reviews?page=2") || updates[0].Matches("/product") {
+		t.Fatalf("Prefix matching failed")
+	}
+	if !updates[1].Matches("/products/4") || !updates[1].Matches("/products/4?page=2") || updates[1].Matches("/products/42") {
+		t.Fatalf("Glob matching failed")
+	}
+	if prefix := updates[1].Prefix(); prefix != "/products/" {
+		t.Fatalf("Prefix is %s", prefix)
+	}
+}
+
+func TestPatternQuery(t *testing.T) {
+	updates := getUpdates(t, "/products/[0-9]?page=*", "/a*b")
+	if !updates[0].Matches("/products/4?page=2") || updates[0].Matches("/products/4?sort=name") ||
+		updates[0].Matches("/products/4Xpage=2") {
+		t.Fatalf("Query matching failed")
+	}
+	if updates[1].Matches("/a?b") || !updates[1].Matches("/axb?c=d") {
+		t.Fatalf("Path matching failed")
+	}
+}
+
+func TestCacheFetchAlias(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/products", nil)
+	res := &http.Response{Header: http.Header{"Cache-Fetch": []string{"/list"}}, Request: req}
+	if updates := GetCacheUpdates(req, res); len(updates) != 1 || updates[0].URI != "/list" {
+		t.Fatalf("Updates are %+v", updates)
+	}
+}
+
+func TestDependencies(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/products/list", nil)
+	res := &http.Response{Header: http.Header{}, Request: req}
+	res.Header.Add("Cache-Depends", "/api/products/42, 43")
+	res.Header.Add("Cache-Depends", "self")
+	deps := GetDependencies(req, res)
+	if len(deps) != 3 || deps[0] != "/api/products/42" || deps[1] != "/products/43" || deps[2] != "/products/list" {
+		t.Fatalf("Dependencies are %v", deps)
+	}
+}
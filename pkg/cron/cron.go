@@ -0,0 +1,155 @@
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed cron expression.
+// Each field is a bit set of the allowed values.
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+	// whether the day fields are restricted, i.e. not `*`
+	domRestricted, dowRestricted bool
+}
+
+type bounds struct {
+	min, max int
+}
+
+var (
+	minuteBounds = bounds{0, 59}
+	hourBounds   = bounds{0, 23}
+	domBounds    = bounds{1, 31}
+	monthBounds  = bounds{1, 12}
+	// 7 is accepted as Sunday in addition to 0
+	dowBounds = bounds{0, 7}
+)
+
+var macros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse parses a standard cron expression with five fields:
+// minute, hour, day of month, month and day of week.
+// Fields support `*`, numbers, ranges (`1-5`), steps (`*/15`, `0-30/10`) and lists (`1,15`).
+// The macros `@yearly`, `@monthly`, `@weekly`, `@daily` and `@hourly` are supported as well.
+func Parse(expr string) (Schedule, error) {
+	expr = strings.TrimSpace(expr)
+	if macro, ok := macros[expr]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return Schedule{}, fmt.Errorf("Cron expression must have 5 fields: %s", expr)
+	}
+	var s Schedule
+	var err error
+	if s.minute, err = parseField(fields[0], minuteBounds); err != nil {
+		return s, err
+	}
+	if s.hour, err = parseField(fields[1], hourBounds); err != nil {
+		return s, err
+	}
+	if s.dom, err = parseField(fields[2], domBounds); err != nil {
+		return s, err
+	}
+	if s.month, err = parseField(fields[3], monthBounds); err != nil {
+		return s, err
+	}
+	if s.dow, err = parseField(fields[4], dowBounds); err != nil {
+		return s, err
+	}
+	// Sunday is both 0 and 7
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domRestricted = fields[2] != "*"
+	s.dowRestricted = fields[4] != "*"
+	return s, nil
+}
+
+// parseField parses a comma-separated list of values, ranges and steps into a bit set.
+func parseField(field string, b bounds) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step <= 0 {
+				return 0, fmt.Errorf("Invalid step in cron field: %s", part)
+			}
+		}
+		start, end := b.min, b.max
+		if rangePart != "*" {
+			startPart, endPart, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if start, err = strconv.Atoi(startPart); err != nil {
+				return 0, fmt.Errorf("Invalid value in cron field: %s", part)
+			}
+			end = start
+			if isRange {
+				if end, err = strconv.Atoi(endPart); err != nil {
+					return 0, fmt.Errorf("Invalid range in cron field: %s", part)
+				}
+			} else if hasStep {
+				end = b.max
+			}
+		}
+		if start < b.min || end > b.max || start > end {
+			return 0, fmt.Errorf("Cron field value out of range: %s", part)
+		}
+		for i := start; i <= end; i += step {
+			set |= 1 << i
+		}
+	}
+	return set, nil
+}
+
+// Next returns the next time after the given time matching the schedule.
+// The returned time is truncated to the minute.
+// It returns the zero time if there is no matching time within five years.
+func (s Schedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// dayMatches checks the day of month and day of week fields.
+// As in standard cron, if both are restricted, matching either one is enough.
+func (s Schedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domRestricted && s.dowRestricted {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
@@ -0,0 +1,40 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func assertNext(t *testing.T, expr string, from, expected string) {
+	s, err := Parse(expr)
+	if err != nil {
+		t.Fatalf("%s: %s", expr, err)
+	}
+	fromTime, _ := time.Parse(time.RFC3339, from)
+	expectedTime, _ := time.Parse(time.RFC3339, expected)
+	if next := s.Next(fromTime); !next.Equal(expectedTime) {
+		t.Fatalf("%s: next after %s is %s, expected %s", expr, from, next, expected)
+	}
+}
+
+func TestNext(t *testing.T) {
+	assertNext(t, "* * * * *", "2022-10-18T10:15:30Z", "2022-10-18T10:16:00Z")
+	assertNext(t, "@hourly", "2022-10-18T10:15:00Z", "2022-10-18T11:00:00Z")
+	assertNext(t, "*/20 * * * *", "2022-10-18T10:15:00Z", "2022-10-18T10:20:00Z")
+	assertNext(t, "30 3 * * *", "2022-10-18T10:15:00Z", "2022-10-19T03:30:00Z")
+	assertNext(t, "0 9-17/4 * * *", "2022-10-18T13:00:00Z", "2022-10-18T17:00:00Z")
+	assertNext(t, "0 0 1 1 *", "2022-10-18T10:15:00Z", "2023-01-01T00:00:00Z")
+	assertNext(t, "0 0 29 2 *", "2022-10-18T10:15:00Z", "2024-02-29T00:00:00Z")
+	// 2022-10-18 is a Tuesday
+	assertNext(t, "0 12 * * 7", "2022-10-18T10:15:00Z", "2022-10-23T12:00:00Z")
+	// either day of month or day of week
+	assertNext(t, "0 0 20 * 3", "2022-10-18T10:15:00Z", "2022-10-19T00:00:00Z")
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{"* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "a * * * *", "5-1 * * * *"} {
+		if _, err := Parse(expr); err == nil {
+			t.Fatalf("%s: expected error", expr)
+		}
+	}
+}
@@ -0,0 +1,377 @@
+package fastcgi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FastCGI record types, see the FastCGI specification.
+const (
+	typeBeginRequest = 1
+	typeEndRequest   = 3
+	typeParams       = 4
+	typeStdin        = 5
+	typeStdout       = 6
+	typeStderr       = 7
+)
+
+const (
+	version1       = 1
+	roleResponder  = 1
+	requestId      = 1
+	maxContentSize = 65535
+	headerSize     = 8
+)
+
+const (
+	defaultIndex           = "index.php"
+	defaultScriptExtension = ".php"
+	defaultDialTimeout     = 10 * time.Second
+)
+
+// Config configures how requests are mapped to scripts on the FastCGI server.
+type Config struct {
+	// Document root of the application on the FastCGI server, e.g. `/var/www/html`.
+	DocumentRoot string
+	// Script handling requests whose path does not name a script, relative to the document root.
+	// Defaults to `index.php`, i.e. a front controller.
+	Index string
+	// Extension of scripts, used for splitting the request path into the script name and path info.
+	// Defaults to `.php`.
+	ScriptExtension string
+	// Timeout for connecting to the FastCGI server. Defaults to 10 seconds.
+	DialTimeout time.Duration
+	// The application is served over HTTPS, e.g. behind a TLS terminating proxy.
+	// Requests received over TLS are passed on as HTTPS regardless.
+	HTTPS bool
+	// Optional function called with the error output of the FastCGI server (e.g. PHP warnings),
+	// once the response has been read. Error output of responses that cannot be parsed
+	// is returned in the error instead.
+	Stderr func(message string)
+}
+
+// Transport is an http.RoundTripper sending requests to a FastCGI server (e.g. PHP-FPM) as a responder.
+// A new connection is used for each request.
+type Transport struct {
+	network string
+	address string
+	config  Config
+}
+
+// New creates a transport for the FastCGI server listening on the given network ("tcp" or "unix") and address.
+func New(network, address string, config Config) *Transport {
+	if config.Index == "" {
+		config.Index = defaultIndex
+	}
+	if config.ScriptExtension == "" {
+		config.ScriptExtension = defaultScriptExtension
+	}
+	if config.DialTimeout == 0 {
+		config.DialTimeout = defaultDialTimeout
+	}
+	return &Transport{
+		network: network,
+		address: address,
+		config:  config,
+	}
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	dialer := net.Dialer{Timeout: t.config.DialTimeout}
+	conn, err := dialer.DialContext(req.Context(), t.network, t.address)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := req.Context().Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := t.writeRequest(conn, req); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// the stdout stream is parsed while records are read
+	pr, pw := io.Pipe()
+	stderr := &bytes.Buffer{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(readResponse(conn, pw, stderr))
+	}()
+	res, err := parseResponse(bufio.NewReader(pr), req)
+	if err != nil {
+		pr.Close()
+		conn.Close()
+		// stderr is written by the reader until it returns
+		<-done
+		if stderr.Len() > 0 {
+			return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return nil, err
+	}
+	res.Body = &body{Reader: res.Body, pipe: pr, conn: conn, done: done, stderr: stderr, report: t.config.Stderr}
+	return res, nil
+}
+
+// writeRequest sends the request to the FastCGI server: the request parameters and the body as stdin.
+func (t *Transport) writeRequest(conn net.Conn, req *http.Request) error {
+	w := bufio.NewWriter(conn)
+	begin := []byte{0, roleResponder, 0, 0, 0, 0, 0, 0}
+	if err := writeRecord(w, typeBeginRequest, begin); err != nil {
+		return err
+	}
+	if err := writeStream(w, typeParams, bytes.NewReader(encodeParams(t.params(req)))); err != nil {
+		return err
+	}
+	var stdin io.Reader = http.NoBody
+	if req.Body != nil {
+		stdin = req.Body
+	}
+	if err := writeStream(w, typeStdin, stdin); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// params returns the CGI parameters of the request.
+func (t *Transport) params(req *http.Request) map[string]string {
+	scriptName, pathInfo := t.splitScript(req.URL.Path)
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	scheme, serverPort := "http", "80"
+	if t.config.HTTPS || req.TLS != nil {
+		scheme, serverPort = "https", "443"
+	}
+	serverName := host
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		serverName, serverPort = h, p
+	}
+	if serverName == "" {
+		serverName = "localhost"
+	}
+	remoteAddr, remotePort := req.RemoteAddr, ""
+	if h, p, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		remoteAddr, remotePort = h, p
+	}
+	params := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "always-cache",
+		"SERVER_PROTOCOL":   "HTTP/1.1",
+		"SERVER_NAME":       serverName,
+		"SERVER_PORT":       serverPort,
+		"REQUEST_SCHEME":    scheme,
+		"REQUEST_METHOD":    req.Method,
+		"REQUEST_URI":       req.URL.RequestURI(),
+		"QUERY_STRING":      req.URL.RawQuery,
+		"DOCUMENT_ROOT":     t.config.DocumentRoot,
+		"DOCUMENT_URI":      scriptName,
+		"SCRIPT_NAME":       scriptName,
+		"SCRIPT_FILENAME":   path.Join(t.config.DocumentRoot, scriptName),
+		"PATH_INFO":         pathInfo,
+		"REMOTE_ADDR":       remoteAddr,
+		"REMOTE_PORT":       remotePort,
+		"HTTP_HOST":         host,
+	}
+	if scheme == "https" {
+		params["HTTPS"] = "on"
+	}
+	if req.ContentLength > 0 {
+		params["CONTENT_LENGTH"] = strconv.FormatInt(req.ContentLength, 10)
+	}
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		params["CONTENT_TYPE"] = ct
+	}
+	for name, values := range req.Header {
+		// the Proxy header is never passed on, see https://httpoxy.org
+		if name == "Content-Type" || name == "Content-Length" || name == "Proxy" {
+			continue
+		}
+		key := "HTTP_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+		params[key] = strings.Join(values, ", ")
+	}
+	return params
+}
+
+// splitScript splits the request path into the script name and the path info following it.
+// Paths not naming a script are handled by the index script.
+func (t *Transport) splitScript(urlPath string) (string, string) {
+	urlPath = path.Clean("/" + urlPath)
+	ext := t.config.ScriptExtension
+	for i := strings.Index(urlPath, ext); i >= 0; {
+		end := i + len(ext)
+		if end == len(urlPath) || urlPath[end] == '/' {
+			return urlPath[:end], urlPath[end:]
+		}
+		next := strings.Index(urlPath[end:], ext)
+		if next < 0 {
+			break
+		}
+		i = end + next
+	}
+	return "/" + strings.TrimPrefix(t.config.Index, "/"), ""
+}
+
+// readResponse reads the records sent by the FastCGI server until the end of the request,
+// writing stdout to the given writer and collecting stderr.
+func readResponse(r io.Reader, stdout io.Writer, stderr *bytes.Buffer) error {
+	br := bufio.NewReader(r)
+	header := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			return err
+		}
+		contentLength := int(binary.BigEndian.Uint16(header[4:6]))
+		content := make([]byte, contentLength+int(header[6]))
+		if _, err := io.ReadFull(br, content); err != nil {
+			return err
+		}
+		content = content[:contentLength]
+		switch header[1] {
+		case typeStdout:
+			if _, err := stdout.Write(content); err != nil {
+				return err
+			}
+		case typeStderr:
+			stderr.Write(content)
+		case typeEndRequest:
+			if len(content) >= 5 && content[4] != 0 {
+				return fmt.Errorf("FastCGI request rejected with protocol status %d", content[4])
+			}
+			return io.EOF
+		}
+	}
+}
+
+// parseResponse parses the CGI response: header fields, an empty line and the body.
+// The status is given by the `Status` header field, and defaults to 302 for redirects and 200 otherwise.
+func parseResponse(br *bufio.Reader, req *http.Request) (*http.Response, error) {
+	mime, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil {
+		if err == io.EOF {
+			return nil, errors.New("FastCGI response ended without headers")
+		}
+		return nil, err
+	}
+	header := http.Header(mime)
+	status := http.StatusOK
+	if s := header.Get("Status"); s != "" {
+		code, _, _ := strings.Cut(s, " ")
+		if status, err = strconv.Atoi(code); err != nil {
+			return nil, fmt.Errorf("Invalid status in FastCGI response: %s", s)
+		}
+		header.Del("Status")
+	} else if header.Get("Location") != "" {
+		status = http.StatusFound
+	}
+	contentLength := int64(-1)
+	if cl := header.Get("Content-Length"); cl != "" {
+		if n, err := strconv.ParseInt(cl, 10, 64); err == nil {
+			contentLength = n
+		}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(br),
+		ContentLength: contentLength,
+		Request:       req,
+	}, nil
+}
+
+// body closes the connection to the FastCGI server when the response body is closed,
+// and reports the error output of the server.
+type body struct {
+	io.Reader
+	pipe   *io.PipeReader
+	conn   net.Conn
+	done   chan struct{}
+	stderr *bytes.Buffer
+	report func(message string)
+}
+
+func (b *body) Close() error {
+	b.pipe.Close()
+	err := b.conn.Close()
+	// stderr is written by the reader until it returns
+	<-b.done
+	if b.report != nil && b.stderr.Len() > 0 {
+		b.report(strings.TrimSpace(b.stderr.String()))
+		b.stderr.Reset()
+	}
+	return err
+}
+
+// writeStream writes the contents of the reader as a stream of records, terminated by an empty record.
+func writeStream(w io.Writer, recordType byte, r io.Reader) error {
+	buf := make([]byte, maxContentSize)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if err := writeRecord(w, recordType, buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	return writeRecord(w, recordType, nil)
+}
+
+// writeRecord writes a single record with the content padded to a multiple of 8 bytes.
+func writeRecord(w io.Writer, recordType byte, content []byte) error {
+	padding := (8 - len(content)%8) % 8
+	header := []byte{version1, recordType, 0, requestId, 0, 0, byte(padding), 0}
+	binary.BigEndian.PutUint16(header[4:6], uint16(len(content)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write(content); err != nil {
+		return err
+	}
+	_, err := w.Write(make([]byte, padding))
+	return err
+}
+
+// encodeParams encodes the name-value pairs of the params stream.
+func encodeParams(params map[string]string) []byte {
+	var b bytes.Buffer
+	for name, value := range params {
+		writeLength(&b, len(name))
+		writeLength(&b, len(value))
+		b.WriteString(name)
+		b.WriteString(value)
+	}
+	return b.Bytes()
+}
+
+// writeLength writes the length of a name or value, in one byte if short and in four bytes otherwise.
+func writeLength(b *bytes.Buffer, n int) {
+	if n < 128 {
+		b.WriteByte(byte(n))
+		return
+	}
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], uint32(n)|1<<31)
+	b.Write(buf[:])
+}
@@ -0,0 +1,200 @@
+package fastcgi
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func startServer(t *testing.T, network, address string) string {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go fcgi.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env := fcgi.ProcessEnv(r)
+		body, _ := io.ReadAll(r.Body)
+		if r.URL.Path == "/redirect" {
+			w.Header().Set("Location", "/elsewhere")
+			w.WriteHeader(http.StatusMovedPermanently)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("X-Script", env["SCRIPT_FILENAME"])
+		// the HTTPS parameter is taken as the TLS state of the request
+		https := ""
+		if r.TLS != nil {
+			https = "on"
+		}
+		w.Header().Set("X-Scheme", env["REQUEST_SCHEME"]+" "+https+" "+env["SERVER_PORT"])
+		w.Write([]byte(r.Method + " " + r.URL.RequestURI() + " " + r.Header.Get("Accept-Language") + " " + string(body)))
+	}))
+	return l.Addr().String()
+}
+
+func TestRoundTrip(t *testing.T) {
+	transport := New("tcp", startServer(t, "tcp", "127.0.0.1:0"), Config{DocumentRoot: "/var/www"})
+
+	req, _ := http.NewRequest("GET", "http://example.com/products?page=2", nil)
+	req.Header.Set("Accept-Language", "fi")
+	res, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(body) != "GET /products?page=2 fi " ||
+		res.Header.Get("Cache-Control") != "max-age=60" || res.Header.Get("X-Script") != "/var/www/index.php" ||
+		res.Header.Get("X-Scheme") != "http  80" {
+		t.Fatalf("Response is %d %v %s", res.StatusCode, res.Header, body)
+	}
+
+	req, _ = http.NewRequest("POST", "http://example.com/api/search.php/extra", strings.NewReader("q=cache"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err = transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "POST /api/search.php/extra  q=cache" ||
+		res.Header.Get("X-Script") != "/var/www/api/search.php" {
+		t.Fatalf("Response is %v %s", res.Header, body)
+	}
+
+	req, _ = http.NewRequest("GET", "http://example.com/redirect", nil)
+	if res, err = transport.RoundTrip(req); err != nil || res.StatusCode != http.StatusMovedPermanently {
+		t.Fatalf("Redirect response is %v (%v)", res, err)
+	}
+	res.Body.Close()
+}
+
+func TestHTTPS(t *testing.T) {
+	transport := New("tcp", startServer(t, "tcp", "127.0.0.1:0"), Config{HTTPS: true})
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	res, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if scheme := res.Header.Get("X-Scheme"); scheme != "https on 443" {
+		t.Fatalf("Scheme parameters are %s", scheme)
+	}
+}
+
+func TestStderrOfSuccessfulResponse(t *testing.T) {
+	var reported []string
+	transport := New("tcp", startRawServer(t, func(w io.Writer) {
+		writeRecord(w, typeStdout, []byte("Content-Type: text/plain\r\n\r\nbody"))
+		writeRecord(w, typeStderr, []byte("PHP Notice: undefined index\n"))
+		writeRecord(w, typeEndRequest, make([]byte, 8))
+	}), Config{Stderr: func(message string) { reported = append(reported, message) }})
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	res, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	res.Body.Close()
+	if string(body) != "body" || len(reported) != 1 || reported[0] != "PHP Notice: undefined index" {
+		t.Fatalf("Body is %s, reported %q", body, reported)
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "fpm.sock")
+	transport := New("unix", startServer(t, "unix", socket), Config{})
+	req, _ := http.NewRequest("GET", "http://example.com/", nil)
+	res, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if body, _ := io.ReadAll(res.Body); string(body) != "GET /  " {
+		t.Fatalf("Body is %s", body)
+	}
+}
+
+func TestSplitScript(t *testing.T) {
+	transport := New("tcp", "", Config{})
+	cases := map[string][2]string{
+		"/":                  {"/index.php", ""},
+		"/about":             {"/index.php", ""},
+		"/admin.php":         {"/admin.php", ""},
+		"/a.php/b/c":         {"/a.php", "/b/c"},
+		"/a.phpx/b.php/info": {"/a.phpx/b.php", "/info"},
+	}
+	for urlPath, expected := range cases {
+		if script, info := transport.splitScript(urlPath); script != expected[0] || info != expected[1] {
+			t.Fatalf("%s split into %s and %s", urlPath, script, info)
+		}
+	}
+}
+
+// startRawServer starts a FastCGI server that reads a request and replies with the given records.
+func startRawServer(t *testing.T, records func(w io.Writer)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// the request ends with an empty stdin record
+		header := make([]byte, headerSize)
+		for {
+			if _, err := io.ReadFull(conn, header); err != nil {
+				return
+			}
+			length := int(binary.BigEndian.Uint16(header[4:6])) + int(header[6])
+			if _, err := io.ReadFull(conn, make([]byte, length)); err != nil {
+				return
+			}
+			if header[1] == typeStdin && length == 0 {
+				break
+			}
+		}
+		records(conn)
+	}()
+	return l.Addr().String()
+}
+
+func TestErrorResponses(t *testing.T) {
+	cases := map[string]func(w io.Writer){
+		"Invalid status in FastCGI response: abc: PHP Warning: broken": func(w io.Writer) {
+			writeRecord(w, typeStderr, []byte("PHP Warning: broken\n"))
+			writeRecord(w, typeStdout, []byte("Status: abc\r\n\r\nbody"))
+			writeRecord(w, typeEndRequest, make([]byte, 8))
+		},
+		// stderr following the headers is read concurrently with the failed parsing
+		"Invalid status in FastCGI response: xyz": func(w io.Writer) {
+			writeRecord(w, typeStdout, []byte("Status: xyz\r\n\r\n"))
+			writeRecord(w, typeStderr, []byte("PHP Warning: late\n"))
+			writeRecord(w, typeEndRequest, make([]byte, 8))
+		},
+		"FastCGI request rejected with protocol status 2": func(w io.Writer) {
+			writeRecord(w, typeEndRequest, []byte{0, 0, 0, 0, 2, 0, 0, 0})
+		},
+		"FastCGI response ended without headers": func(w io.Writer) {
+			writeRecord(w, typeEndRequest, make([]byte, 8))
+		},
+	}
+	for expected, records := range cases {
+		transport := New("tcp", startRawServer(t, records), Config{})
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		if res, err := transport.RoundTrip(req); err == nil || !strings.HasPrefix(err.Error(), expected) {
+			t.Fatalf("Response is %v (%v), expected error %s", res, err, expected)
+		}
+	}
+}
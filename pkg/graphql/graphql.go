@@ -0,0 +1,225 @@
+package graphql
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/always-cache/always-cache/rfc9111"
+)
+
+// OperationType is the type of a GraphQL operation.
+type OperationType string
+
+const (
+	Query        OperationType = "query"
+	Mutation     OperationType = "mutation"
+	Subscription OperationType = "subscription"
+)
+
+// Header listing the types touched by a query, or modified by a mutation.
+const typesHeader = "Cache-Types"
+
+// Request is a GraphQL-over-HTTP request.
+type Request struct {
+	Query         string          `json:"query"`
+	OperationName string          `json:"operationName,omitempty"`
+	Variables     json.RawMessage `json:"variables,omitempty"`
+	Extensions    json.RawMessage `json:"extensions,omitempty"`
+}
+
+// ParseRequest parses the GraphQL request from the URL parameters of a GET request,
+// or from the body of a POST request (either JSON or `application/graphql`).
+func ParseRequest(r *http.Request, body []byte) (Request, error) {
+	var req Request
+	switch r.Method {
+	case http.MethodGet:
+		params := r.URL.Query()
+		req.Query = params.Get("query")
+		req.OperationName = params.Get("operationName")
+		if v := params.Get("variables"); v != "" {
+			req.Variables = json.RawMessage(v)
+		}
+		if e := params.Get("extensions"); e != "" {
+			req.Extensions = json.RawMessage(e)
+		}
+	case http.MethodPost:
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType == "application/graphql" {
+			req.Query = string(body)
+		} else if err := json.Unmarshal(body, &req); err != nil {
+			return req, err
+		}
+	default:
+		return req, fmt.Errorf("Method not supported for GraphQL: %s", r.Method)
+	}
+	if req.Query == "" {
+		return req, fmt.Errorf("GraphQL query missing")
+	}
+	return req, nil
+}
+
+// Normalize returns the request with normalized query text and canonical variables and extensions,
+// so that equal operations result in equal requests.
+func (req Request) Normalize() (Request, error) {
+	tokens, err := tokenize(req.Query)
+	if err != nil {
+		return req, err
+	}
+	req.Query = join(dropQueryKeywords(tokens))
+	if req.Variables, err = canonicalJSON(req.Variables); err != nil {
+		return req, err
+	}
+	if req.Extensions, err = canonicalJSON(req.Extensions); err != nil {
+		return req, err
+	}
+	return req, nil
+}
+
+// OperationType returns the type of the operation to execute,
+// which is the one named by OperationName or the only operation in the query.
+func (req Request) OperationType() (OperationType, error) {
+	tokens, err := tokenize(req.Query)
+	if err != nil {
+		return "", err
+	}
+	operations := operations(tokens)
+	if req.OperationName != "" {
+		for _, op := range operations {
+			if op.name == req.OperationName {
+				return op.typ, nil
+			}
+		}
+		return "", fmt.Errorf("GraphQL operation not found: %s", req.OperationName)
+	}
+	if len(operations) != 1 {
+		return "", fmt.Errorf("GraphQL query must contain exactly one operation if no name is given")
+	}
+	return operations[0].typ, nil
+}
+
+// URLQuery returns the request encoded as URL parameters, for GET requests.
+func (req Request) URLQuery() string {
+	params := url.Values{}
+	params.Set("query", req.Query)
+	if req.OperationName != "" {
+		params.Set("operationName", req.OperationName)
+	}
+	if len(req.Variables) > 0 {
+		params.Set("variables", string(req.Variables))
+	}
+	if len(req.Extensions) > 0 {
+		params.Set("extensions", string(req.Extensions))
+	}
+	return params.Encode()
+}
+
+// ResponseTypes returns the types declared by the response, either in the `Cache-Types` header
+// or in the `cacheTypes` response extension.
+// For queries, these are the types touched by the query, and for mutations the types modified.
+func ResponseTypes(header http.Header, body []byte) []string {
+	types := rfc9111.GetListHeader(header, typesHeader)
+	var res struct {
+		Extensions struct {
+			CacheTypes []string `json:"cacheTypes"`
+		} `json:"extensions"`
+	}
+	if err := json.Unmarshal(body, &res); err == nil {
+		types = append(types, res.Extensions.CacheTypes...)
+	}
+	return types
+}
+
+// canonicalJSON returns the JSON value with sorted object keys and without whitespace.
+// Null values are returned as empty.
+func canonicalJSON(raw json.RawMessage) (json.RawMessage, error) {
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return nil, nil
+	}
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, nil
+	}
+	return json.Marshal(v)
+}
+
+type operation struct {
+	typ  OperationType
+	name string
+}
+
+// operations returns the operation definitions of the tokenized query document.
+// A selection set without an operation type (the query shorthand) is an anonymous query.
+func operations(tokens []token) []operation {
+	ops := make([]operation, 0)
+	braces, parens := 0, 0
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		if braces == 0 && parens == 0 {
+			switch {
+			case t.kind == punctuator && t.text == "{":
+				// selection set of the previous definition, or the query shorthand
+				if i == 0 || tokens[i-1].kind == punctuator && tokens[i-1].text == "}" {
+					ops = append(ops, operation{typ: Query})
+				}
+			case t.kind == name && (t.text == "query" || t.text == "mutation" || t.text == "subscription"):
+				op := operation{typ: OperationType(t.text)}
+				if i+1 < len(tokens) && tokens[i+1].kind == name {
+					op.name = tokens[i+1].text
+					i++
+				}
+				ops = append(ops, op)
+				continue
+			}
+		}
+		if t.kind == punctuator {
+			switch t.text {
+			case "{":
+				braces++
+			case "}":
+				braces--
+			case "(":
+				parens++
+			case ")":
+				parens--
+			}
+		}
+	}
+	return ops
+}
+
+// dropQueryKeywords removes the `query` keyword from anonymous queries without variables or directives,
+// since they are equal to the query shorthand (a plain selection set).
+func dropQueryKeywords(tokens []token) []token {
+	result := make([]token, 0, len(tokens))
+	for i, t := range tokens {
+		definitionStart := i == 0 || tokens[i-1].kind == punctuator && tokens[i-1].text == "}"
+		if definitionStart && t.kind == name && t.text == "query" &&
+			i+1 < len(tokens) && tokens[i+1].kind == punctuator && tokens[i+1].text == "{" {
+			continue
+		}
+		result = append(result, t)
+	}
+	return result
+}
+
+// join joins the tokens with a single space where needed to separate them.
+func join(tokens []token) string {
+	var b strings.Builder
+	for i, t := range tokens {
+		if i > 0 && t.kind != punctuator && tokens[i-1].kind != punctuator {
+			b.WriteByte(' ')
+		}
+		b.WriteString(t.text)
+	}
+	return b.String()
+}
@@ -0,0 +1,93 @@
+package graphql
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	a := Request{
+		Query: `query Product($id: ID!) {
+			# the product
+			product(id: $id) { name, price ...Extra }
+		}`,
+		Variables: []byte(`{"id": "42", "currency": "EUR"}`),
+	}
+	b := Request{
+		Query:     `query Product($id:ID!){product(id:$id){name price...Extra}}`,
+		Variables: []byte(`{"currency":"EUR","id":"42"}`),
+	}
+	na, err := a.Normalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nb, err := b.Normalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if na.Query != nb.Query || string(na.Variables) != string(nb.Variables) {
+		t.Fatalf("Normalized requests differ: %+v and %+v", na, nb)
+	}
+	if expected := `query Product($id:ID!){product(id:$id){name price...Extra}}`; na.Query != expected {
+		t.Fatalf("Normalized query is %s", na.Query)
+	}
+
+	// anonymous queries are equal to the query shorthand
+	d, _ := Request{Query: `query { a }`}.Normalize()
+	if d.Query != `{a}` {
+		t.Fatalf("Normalized query is %s", d.Query)
+	}
+
+	// whitespace in strings is significant
+	c, _ := Request{Query: `{ search(q: "a  b") }`}.Normalize()
+	if c.Query != `{search(q:"a  b")}` {
+		t.Fatalf("Normalized query is %s", c.Query)
+	}
+}
+
+func TestOperationType(t *testing.T) {
+	cases := []struct {
+		query, operationName string
+		expected             OperationType
+	}{
+		{`{ products { name } }`, "", Query},
+		{`query { products { name } }`, "", Query},
+		{`mutation AddProduct($p: ProductInput = {name: "x"}) { addProduct(p: $p) { id } }`, "", Mutation},
+		{`subscription { productAdded { id } }`, "", Subscription},
+		{`query A { a } mutation B { b }`, "B", Mutation},
+		{`fragment F on Product { name } query { products { ...F } }`, "", Query},
+	}
+	for _, c := range cases {
+		typ, err := Request{Query: c.query, OperationName: c.operationName}.OperationType()
+		if err != nil || typ != c.expected {
+			t.Fatalf("%s: got %s (%v), expected %s", c.query, typ, err, c.expected)
+		}
+	}
+	if _, err := (Request{Query: `query A { a } query B { b }`}).OperationType(); err == nil {
+		t.Fatalf("Expected error for ambiguous operation")
+	}
+}
+
+func TestParseRequest(t *testing.T) {
+	r, _ := http.NewRequest("GET", `/graphql?query={a}&variables={"x":1}`, nil)
+	req, err := ParseRequest(r, nil)
+	if err != nil || req.Query != "{a}" || string(req.Variables) != `{"x":1}` {
+		t.Fatalf("Got %+v (%v)", req, err)
+	}
+	body := `{"query": "{a}", "operationName": null}`
+	r, _ = http.NewRequest("POST", "/graphql", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	if req, err = ParseRequest(r, []byte(body)); err != nil || req.Query != "{a}" {
+		t.Fatalf("Got %+v (%v)", req, err)
+	}
+}
+
+func TestResponseTypes(t *testing.T) {
+	header := http.Header{"Cache-Types": {"Product, Category"}}
+	body := []byte(`{"data": {}, "extensions": {"cacheTypes": ["Review"]}}`)
+	types := ResponseTypes(header, body)
+	if strings.Join(types, ",") != "Product,Category,Review" {
+		t.Fatalf("Types are %v", types)
+	}
+}
@@ -0,0 +1,98 @@
+package graphql
+
+import (
+	"fmt"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	punctuator tokenKind = iota
+	name
+	number
+	stringValue
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+// tokenize splits the GraphQL document into tokens,
+// dropping the insignificant whitespace, commas and comments.
+func tokenize(doc string) ([]token, error) {
+	tokens := make([]token, 0)
+	for i := 0; i < len(doc); {
+		c := doc[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case c == '#':
+			for i < len(doc) && doc[i] != '\n' && doc[i] != '\r' {
+				i++
+			}
+		case strings.HasPrefix(doc[i:], "..."):
+			tokens = append(tokens, token{punctuator, "..."})
+			i += 3
+		case strings.IndexByte("!$&():=@[]{|}", c) >= 0:
+			tokens = append(tokens, token{punctuator, string(c)})
+			i++
+		case c == '_' || isLetter(c):
+			start := i
+			for i < len(doc) && (doc[i] == '_' || isLetter(doc[i]) || isDigit(doc[i])) {
+				i++
+			}
+			tokens = append(tokens, token{name, doc[start:i]})
+		case c == '-' || isDigit(c):
+			start := i
+			i++
+			for i < len(doc) && (isDigit(doc[i]) || strings.IndexByte(".eE+-", doc[i]) >= 0) {
+				i++
+			}
+			tokens = append(tokens, token{number, doc[start:i]})
+		case strings.HasPrefix(doc[i:], `"""`):
+			end := i + 3
+			for {
+				next := strings.Index(doc[end:], `"""`)
+				if next < 0 {
+					return nil, fmt.Errorf("Unterminated block string in GraphQL query")
+				}
+				end += next + 3
+				// escaped triple quotes do not end the string
+				if doc[end-4] != '\\' {
+					break
+				}
+			}
+			tokens = append(tokens, token{stringValue, doc[i:end]})
+			i = end
+		case c == '"':
+			start := i
+			i++
+			for i < len(doc) && doc[i] != '"' {
+				if doc[i] == '\\' {
+					i++
+				} else if doc[i] == '\n' || doc[i] == '\r' {
+					return nil, fmt.Errorf("Unterminated string in GraphQL query")
+				}
+				i++
+			}
+			if i >= len(doc) {
+				return nil, fmt.Errorf("Unterminated string in GraphQL query")
+			}
+			i++
+			tokens = append(tokens, token{stringValue, doc[start:i]})
+		default:
+			return nil, fmt.Errorf("Unexpected character in GraphQL query: %q", c)
+		}
+	}
+	return tokens, nil
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
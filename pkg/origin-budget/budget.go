@@ -0,0 +1,176 @@
+package budget
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// Maximum slowdown factor of background fetches when the origin is overloaded.
+	maxFactor = 64
+	// Minimum interval between background fetches when slowing down without a rate limit.
+	minBackoffInterval = 10 * time.Millisecond
+	// Minimum time between adjustments of the slowdown factor.
+	adjustInterval = time.Second
+	// Weight of the latest observation in the moving averages.
+	alpha = 0.2
+)
+
+// Config limits the load put on the origin by background fetches.
+// The zero value means no limits.
+type Config struct {
+	// Maximum number of concurrent fetches to the origin.
+	// Client-driven fetches are counted as well, but they never wait.
+	MaxConcurrent int
+	// Maximum number of background fetches started per second.
+	RequestsPerSecond float64
+	// Average origin latency above which background fetches are slowed down.
+	SlowLatency time.Duration
+	// Fraction of 5xx (or failed) origin responses above which background fetches are slowed down.
+	MaxErrorRate float64
+}
+
+// Budget decides when background fetches may be sent to the origin.
+// Background fetches wait for a free slot, for the rate limit and for the origin to recover
+// when it is overloaded. Client-driven (foreground) fetches always go through immediately,
+// but take up slots, which gives them priority over background work.
+type Budget struct {
+	config   Config
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	inFlight int
+	// next time a background fetch may be started
+	next time.Time
+	// current slowdown factor, 1 meaning no slowdown
+	factor     int
+	adjustedAt time.Time
+	latency    float64
+	errorRate  float64
+}
+
+// Stats is a snapshot of the state of the budget.
+type Stats struct {
+	InFlight  int
+	Factor    int
+	Latency   time.Duration
+	ErrorRate float64
+}
+
+// Done is called when a fetch completes, with the origin response status and latency.
+// A status of 0 means the fetch failed.
+type Done func(status int, latency time.Duration)
+
+// New creates a budget with the given limits.
+func New(config Config) *Budget {
+	b := &Budget{
+		config: config,
+		factor: 1,
+	}
+	b.cond = sync.NewCond(&b.mutex)
+	return b
+}
+
+// Background waits until a background fetch may be sent to the origin.
+// The rate limit is waited for first, so that fetches waiting for their turn do not take up slots.
+// The returned function must be called when the fetch completes.
+func (b *Budget) Background() Done {
+	b.mutex.Lock()
+	now := time.Now()
+	if b.next.Before(now) {
+		b.next = now
+	}
+	wait := b.next.Sub(now)
+	b.next = b.next.Add(b.interval())
+	b.mutex.Unlock()
+
+	time.Sleep(wait)
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for b.config.MaxConcurrent > 0 && b.inFlight >= b.concurrency() {
+		b.cond.Wait()
+	}
+	b.inFlight++
+	return b.done
+}
+
+// Foreground registers a client-driven fetch, which is never delayed.
+// The returned function must be called when the fetch completes.
+func (b *Budget) Foreground() Done {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.inFlight++
+	return b.done
+}
+
+// Stats returns the current state of the budget.
+func (b *Budget) Stats() Stats {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return Stats{
+		InFlight:  b.inFlight,
+		Factor:    b.factor,
+		Latency:   time.Duration(b.latency),
+		ErrorRate: b.errorRate,
+	}
+}
+
+func (b *Budget) done(status int, latency time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.inFlight--
+	b.observe(status, latency)
+	b.cond.Broadcast()
+}
+
+// observe updates the moving averages and adjusts the slowdown factor.
+// The factor is doubled when the origin is overloaded and halved when it has recovered.
+func (b *Budget) observe(status int, latency time.Duration) {
+	failed := 0.0
+	if status == 0 || status >= 500 {
+		failed = 1
+	}
+	b.latency = alpha*float64(latency) + (1-alpha)*b.latency
+	b.errorRate = alpha*failed + (1-alpha)*b.errorRate
+
+	if time.Since(b.adjustedAt) < adjustInterval {
+		return
+	}
+	if b.overloaded() {
+		if b.factor < maxFactor {
+			b.factor *= 2
+			b.adjustedAt = time.Now()
+		}
+	} else if b.factor > 1 {
+		b.factor /= 2
+		b.adjustedAt = time.Now()
+	}
+}
+
+func (b *Budget) overloaded() bool {
+	return (b.config.SlowLatency > 0 && time.Duration(b.latency) > b.config.SlowLatency) ||
+		(b.config.MaxErrorRate > 0 && b.errorRate > b.config.MaxErrorRate)
+}
+
+// concurrency returns the effective maximum number of concurrent fetches.
+func (b *Budget) concurrency() int {
+	if c := b.config.MaxConcurrent / b.factor; c > 1 {
+		return c
+	}
+	return 1
+}
+
+// interval returns the effective minimum time between background fetches.
+func (b *Budget) interval() time.Duration {
+	var interval time.Duration
+	if b.config.RequestsPerSecond > 0 {
+		interval = time.Duration(float64(time.Second) / b.config.RequestsPerSecond)
+	}
+	if b.factor > 1 {
+		if interval < minBackoffInterval {
+			interval = minBackoffInterval
+		}
+		interval *= time.Duration(b.factor)
+	}
+	return interval
+}
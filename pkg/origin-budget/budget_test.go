@@ -0,0 +1,94 @@
+package budget
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMaxConcurrent(t *testing.T) {
+	b := New(Config{MaxConcurrent: 2})
+	var running, maxRunning atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			done := b.Background()
+			if n := running.Add(1); n > maxRunning.Load() {
+				maxRunning.Store(n)
+			}
+			time.Sleep(20 * time.Millisecond)
+			running.Add(-1)
+			done(200, 20*time.Millisecond)
+		}()
+	}
+	wg.Wait()
+	if max := maxRunning.Load(); max != 2 {
+		t.Fatalf("Max concurrent fetches %d, expected 2", max)
+	}
+}
+
+func TestForegroundTakesPriority(t *testing.T) {
+	b := New(Config{MaxConcurrent: 1})
+	foregroundDone := b.Foreground()
+	started := make(chan bool)
+	go func() {
+		b.Background()(200, 0)
+		started <- true
+	}()
+	select {
+	case <-started:
+		t.Fatalf("Background fetch started while foreground fetch in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	foregroundDone(200, 0)
+	<-started
+}
+
+func TestRequestsPerSecond(t *testing.T) {
+	b := New(Config{RequestsPerSecond: 20})
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		b.Background()(200, 0)
+	}
+	// the first fetch is not delayed
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatalf("5 fetches took %s, expected at least 200ms", elapsed)
+	}
+}
+
+func TestRateLimitedFetchesDoNotTakeSlots(t *testing.T) {
+	b := New(Config{MaxConcurrent: 2, RequestsPerSecond: 5})
+	done := b.Background()
+	go func() {
+		b.Background()(200, 0)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if stats := b.Stats(); stats.InFlight != 1 {
+		t.Fatalf("%d fetches in flight while waiting for the rate limit, expected 1", stats.InFlight)
+	}
+	done(200, 0)
+}
+
+func TestSlowDownOnErrors(t *testing.T) {
+	b := New(Config{MaxConcurrent: 8, MaxErrorRate: 0.5})
+	for i := 0; i < 5; i++ {
+		b.Foreground()(503, 0)
+	}
+	if factor := b.Stats().Factor; factor != 2 {
+		t.Fatalf("Factor is %d, expected 2", factor)
+	}
+	if c := b.concurrency(); c != 4 {
+		t.Fatalf("Concurrency is %d, expected 4", c)
+	}
+	// recovers when the origin is healthy again
+	for i := 0; i < 20; i++ {
+		b.adjustedAt = time.Time{}
+		b.Foreground()(200, 0)
+	}
+	if factor := b.Stats().Factor; factor != 1 {
+		t.Fatalf("Factor is %d, expected 1", factor)
+	}
+}
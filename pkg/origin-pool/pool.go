@@ -0,0 +1,345 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Balancing is the strategy for choosing the member to send a request to.
+type Balancing string
+
+const (
+	RoundRobin       Balancing = "round-robin"
+	LeastConnections Balancing = "least-connections"
+)
+
+const (
+	defaultHealthInterval = 10 * time.Second
+	defaultHealthTimeout  = 5 * time.Second
+	defaultMaxFailures    = 3
+	defaultEjectDuration  = 30 * time.Second
+)
+
+var ErrNoMembers = errors.New("No origin pool members")
+
+// Config configures a pool of servers serving the same logical origin.
+type Config struct {
+	// Addresses of the pool members, e.g. `https://10.0.0.1:8443`. Only scheme and host are used.
+	Addresses []url.URL
+	// Strategy for choosing the member for a request. Defaults to round-robin.
+	Balancing Balancing
+	// Path requested from each member to check its health, e.g. `/healthz`.
+	// Members not responding with a 2xx or 3xx status are not used until they do.
+	// Active health checks are disabled if empty.
+	HealthPath string
+	// Interval of active health checks. Defaults to 10 seconds.
+	HealthInterval time.Duration
+	// Timeout of active health checks. Defaults to 5 seconds.
+	HealthTimeout time.Duration
+	// Host header of active health checks. Defaults to the member address.
+	HealthHost string
+	// Number of consecutive failed requests after which a member is ejected from the pool.
+	// Failed requests are connection errors and 502, 503 and 504 responses. Defaults to 3.
+	MaxFailures int
+	// Time an ejected member is not used, after which it is tried again. Defaults to 30 seconds.
+	EjectDuration time.Duration
+	// Optional function called when a member becomes available or unavailable.
+	OnChange func(MemberStats)
+}
+
+// Pool is an http.RoundTripper sending requests to the members of the pool.
+// Requests failing on one member are retried on another one if they are idempotent,
+// or if the connection to the member could not be established.
+type Pool struct {
+	config    Config
+	transport http.RoundTripper
+	mutex     sync.Mutex
+	members   []*member
+	// index of the member after the previously chosen one, for round-robin balancing
+	next int
+	// closed to stop the active health checks
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type member struct {
+	url          url.URL
+	active       int
+	failures     int
+	healthy      bool
+	ejectedUntil time.Time
+	// availability last reported to OnChange
+	reported bool
+	requests int64
+	errors   int64
+}
+
+// MemberStats is a snapshot of the state of a pool member.
+type MemberStats struct {
+	Address string
+	// The member is used for requests, i.e. it is healthy and not ejected.
+	Available bool
+	// Result of the latest active health check (true if checks are disabled).
+	Healthy bool
+	// Number of requests in flight.
+	Active int
+	// Number of consecutive failed requests.
+	Failures int
+	Requests int64
+	Errors   int64
+}
+
+// New creates a pool sending requests with the given transport.
+// Active health checks are started if configured.
+func New(config Config, transport http.RoundTripper) *Pool {
+	if config.HealthInterval == 0 {
+		config.HealthInterval = defaultHealthInterval
+	}
+	if config.HealthTimeout == 0 {
+		config.HealthTimeout = defaultHealthTimeout
+	}
+	if config.MaxFailures == 0 {
+		config.MaxFailures = defaultMaxFailures
+	}
+	if config.EjectDuration == 0 {
+		config.EjectDuration = defaultEjectDuration
+	}
+	p := &Pool{
+		config:    config,
+		transport: transport,
+		done:      make(chan struct{}),
+	}
+	for _, address := range config.Addresses {
+		p.members = append(p.members, &member{url: address, healthy: true, reported: true})
+	}
+	if config.HealthPath != "" {
+		go p.checkHealth()
+	}
+	return p
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (p *Pool) RoundTrip(req *http.Request) (*http.Response, error) {
+	tried := make(map[*member]bool, len(p.members))
+	m := p.pick(tried)
+	if m == nil {
+		return nil, ErrNoMembers
+	}
+	attempt := req
+	for {
+		tried[m] = true
+		res, err := p.send(m, attempt)
+		if !failed(res, err) || !mayRetry(req, err) {
+			return res, err
+		}
+		next := p.pick(tried)
+		if next == nil {
+			return res, err
+		}
+		if res != nil {
+			res.Body.Close()
+		}
+		attempt = req.Clone(req.Context())
+		if req.Body != nil && req.Body != http.NoBody {
+			if attempt.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		m = next
+	}
+}
+
+// Stats returns the state of each pool member.
+func (p *Pool) Stats() []MemberStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := time.Now()
+	stats := make([]MemberStats, len(p.members))
+	for i, m := range p.members {
+		stats[i] = m.stats(now)
+	}
+	return stats
+}
+
+// send sends the request to the member and records the result.
+func (p *Pool) send(m *member, req *http.Request) (*http.Response, error) {
+	p.mutex.Lock()
+	m.active++
+	m.requests++
+	p.mutex.Unlock()
+
+	out := req.Clone(req.Context())
+	out.URL.Scheme = m.url.Scheme
+	out.URL.Host = m.url.Host
+	res, err := p.transport.RoundTrip(out)
+
+	p.mutex.Lock()
+	m.active--
+	if failed(res, err) {
+		p.recordFailure(m)
+	} else {
+		m.failures = 0
+		m.ejectedUntil = time.Time{}
+		p.report(m, time.Now())
+	}
+	p.mutex.Unlock()
+	return res, err
+}
+
+// recordFailure ejects the member after too many consecutive failures.
+// The mutex must be held.
+func (p *Pool) recordFailure(m *member) {
+	now := time.Now()
+	m.errors++
+	m.failures++
+	if m.failures >= p.config.MaxFailures && m.available(now) {
+		m.ejectedUntil = now.Add(p.config.EjectDuration)
+		p.report(m, now)
+	}
+}
+
+// pick chooses an available member that has not been tried yet.
+// If no member is available, any untried member is chosen, as it is better to try than to fail outright.
+func (p *Pool) pick(tried map[*member]bool) *member {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := time.Now()
+	for _, m := range p.members {
+		// ejections expire without any event, report them when noticed
+		p.report(m, now)
+	}
+	var chosen *member
+	for _, onlyAvailable := range []bool{true, false} {
+		n := len(p.members)
+		for i := 0; i < n; i++ {
+			idx := (p.next + i) % n
+			m := p.members[idx]
+			if tried[m] || onlyAvailable && !m.available(now) {
+				continue
+			}
+			if chosen == nil || p.config.Balancing == LeastConnections && m.active < chosen.active {
+				chosen = m
+			}
+			if p.config.Balancing != LeastConnections {
+				break
+			}
+		}
+		if chosen != nil {
+			break
+		}
+	}
+	if chosen != nil {
+		for idx, m := range p.members {
+			if m == chosen {
+				p.next = idx + 1
+			}
+		}
+	}
+	return chosen
+}
+
+// Close stops the active health checks. Requests can still be sent through the pool.
+func (p *Pool) Close() {
+	p.closeOnce.Do(func() { close(p.done) })
+}
+
+// checkHealth periodically probes each member until the pool is closed.
+func (p *Pool) checkHealth() {
+	ticker := time.NewTicker(p.config.HealthInterval)
+	defer ticker.Stop()
+	for {
+		for _, m := range p.members {
+			healthy := p.probe(m.url)
+			p.mutex.Lock()
+			m.healthy = healthy
+			p.report(m, time.Now())
+			p.mutex.Unlock()
+		}
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe requests the health path from the member.
+func (p *Pool) probe(address url.URL) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.HealthTimeout)
+	defer cancel()
+	address.Path = p.config.HealthPath
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, address.String(), nil)
+	if err != nil {
+		return false
+	}
+	if p.config.HealthHost != "" {
+		req.Host = p.config.HealthHost
+	}
+	res, err := p.transport.RoundTrip(req)
+	if err != nil {
+		return false
+	}
+	res.Body.Close()
+	return res.StatusCode >= 200 && res.StatusCode < 400
+}
+
+// report reports the availability of the member if it changed since it was last reported,
+// including ejections that expired in the meantime. The mutex must be held.
+func (p *Pool) report(m *member, now time.Time) {
+	available := m.available(now)
+	if available == m.reported {
+		return
+	}
+	m.reported = available
+	if p.config.OnChange != nil {
+		p.config.OnChange(m.stats(now))
+	}
+}
+
+func (m *member) available(now time.Time) bool {
+	return m.healthy && !now.Before(m.ejectedUntil)
+}
+
+func (m *member) stats(now time.Time) MemberStats {
+	return MemberStats{
+		Address:   m.url.String(),
+		Available: m.available(now),
+		Healthy:   m.healthy,
+		Active:    m.active,
+		Failures:  m.failures,
+		Requests:  m.requests,
+		Errors:    m.errors,
+	}
+}
+
+// failed checks if the request failed because of the member, rather than the request.
+func failed(res *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return res.StatusCode == http.StatusBadGateway ||
+		res.StatusCode == http.StatusServiceUnavailable ||
+		res.StatusCode == http.StatusGatewayTimeout
+}
+
+// mayRetry checks if the failed request may be sent to another member.
+// Idempotent requests may always be retried, others only if they never reached the member.
+func mayRetry(req *http.Request, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
@@ -0,0 +1,168 @@
+package pool
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newStatus(code int) *atomic.Int32 {
+	status := &atomic.Int32{}
+	status.Store(int32(code))
+	return status
+}
+
+func newMember(t *testing.T, name string, status *atomic.Int32) *url.URL {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(status.Load()))
+		w.Write([]byte(name))
+	}))
+	t.Cleanup(server.Close)
+	u, _ := url.Parse(server.URL)
+	return u
+}
+
+func get(t *testing.T, p *Pool, method string) string {
+	req, _ := http.NewRequest(method, "http://origin/", nil)
+	res, err := p.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	return string(body)
+}
+
+func TestRoundRobin(t *testing.T) {
+	ok := newStatus(http.StatusOK)
+	p := New(Config{Addresses: []url.URL{*newMember(t, "a", ok), *newMember(t, "b", ok)}}, http.DefaultTransport)
+	var bodies []string
+	for i := 0; i < 4; i++ {
+		bodies = append(bodies, get(t, p, "GET"))
+	}
+	if strings.Join(bodies, "") != "abab" {
+		t.Fatalf("Members used are %v", bodies)
+	}
+}
+
+func TestFailoverAndEjection(t *testing.T) {
+	ok, unavailable := newStatus(http.StatusOK), newStatus(http.StatusServiceUnavailable)
+	var changes []MemberStats
+	p := New(Config{
+		Addresses:     []url.URL{*newMember(t, "a", unavailable), *newMember(t, "b", ok)},
+		MaxFailures:   2,
+		EjectDuration: time.Minute,
+		OnChange:      func(s MemberStats) { changes = append(changes, s) },
+	}, http.DefaultTransport)
+
+	for i := 0; i < 4; i++ {
+		if body := get(t, p, "GET"); body != "b" {
+			t.Fatalf("Response %d is from %s", i, body)
+		}
+	}
+	stats := p.Stats()
+	if stats[0].Available || stats[0].Requests != 2 || !stats[1].Available {
+		t.Fatalf("Stats are %+v", stats)
+	}
+	if len(changes) != 1 || changes[0].Available {
+		t.Fatalf("Changes are %+v", changes)
+	}
+
+	// unsafe requests reaching a member are not retried
+	p = New(Config{Addresses: []url.URL{*newMember(t, "a", unavailable), *newMember(t, "b", ok)}}, http.DefaultTransport)
+	if body := get(t, p, "POST"); body != "a" {
+		t.Fatalf("POST response is from %s", body)
+	}
+}
+
+func TestEjectionExpiryIsReported(t *testing.T) {
+	ok, unavailable := newStatus(http.StatusOK), newStatus(http.StatusServiceUnavailable)
+	var changes []MemberStats
+	p := New(Config{
+		Addresses:     []url.URL{*newMember(t, "a", unavailable), *newMember(t, "b", ok)},
+		MaxFailures:   1,
+		EjectDuration: 50 * time.Millisecond,
+		OnChange:      func(s MemberStats) { changes = append(changes, s) },
+	}, http.DefaultTransport)
+
+	get(t, p, "GET")
+	time.Sleep(100 * time.Millisecond)
+	// the expired member is tried again, and ejected again
+	get(t, p, "GET")
+	if len(changes) != 3 || changes[0].Available || !changes[1].Available || changes[2].Available {
+		t.Fatalf("Changes are %+v", changes)
+	}
+}
+
+func TestUnreachableMember(t *testing.T) {
+	ok := newStatus(http.StatusOK)
+	closed := httptest.NewServer(nil)
+	closed.Close()
+	down, _ := url.Parse(closed.URL)
+	p := New(Config{Addresses: []url.URL{*down, *newMember(t, "up", ok)}}, http.DefaultTransport)
+	// requests that never reached a member are retried regardless of method
+	for _, method := range []string{"GET", "POST"} {
+		if body := get(t, p, method); body != "up" {
+			t.Fatalf("%s response is from %s", method, body)
+		}
+	}
+	if stats := p.Stats(); stats[0].Errors != 2 {
+		t.Fatalf("Stats are %+v", stats)
+	}
+}
+
+func TestHealthChecks(t *testing.T) {
+	ok, failing := newStatus(http.StatusOK), newStatus(http.StatusInternalServerError)
+	p := New(Config{
+		Addresses:      []url.URL{*newMember(t, "a", failing), *newMember(t, "b", ok)},
+		HealthPath:     "/health",
+		HealthInterval: 10 * time.Millisecond,
+	}, http.DefaultTransport)
+	defer p.Close()
+	time.Sleep(50 * time.Millisecond)
+	if stats := p.Stats(); stats[0].Healthy || stats[0].Available || !stats[1].Available {
+		t.Fatalf("Stats are %+v", stats)
+	}
+	for i := 0; i < 3; i++ {
+		if body := get(t, p, "GET"); body != "b" {
+			t.Fatalf("Response %d is from %s", i, body)
+		}
+	}
+
+	failing.Store(http.StatusOK)
+	time.Sleep(50 * time.Millisecond)
+	if stats := p.Stats(); !stats[0].Available {
+		t.Fatalf("Stats are %+v", stats)
+	}
+}
+
+func TestCloseStopsHealthChecks(t *testing.T) {
+	var probes atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes.Add(1)
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	p := New(Config{
+		Addresses:      []url.URL{*u},
+		HealthPath:     "/health",
+		HealthInterval: 10 * time.Millisecond,
+	}, http.DefaultTransport)
+	time.Sleep(50 * time.Millisecond)
+	p.Close()
+	p.Close()
+	time.Sleep(20 * time.Millisecond)
+	closed := probes.Load()
+	if closed == 0 {
+		t.Fatal("Members were not probed")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := probes.Load(); n != closed {
+		t.Fatalf("Members were probed %d times after closing", n-closed)
+	}
+}
@@ -10,13 +10,13 @@ import (
 // ResponseSaver is a wrapper around http.ResponseWriter that saves the response to a buffer.
 // It optionally writes the response to the underlying http.ResponseWriter.
 type ResponseSaver struct {
-	rw           http.ResponseWriter
-	b            *bytes.Buffer
-	header       http.Header
-	status       int
-	wroteHeaders bool
-	statusFilter int
-	CreatedAt    time.Time
+	rw            http.ResponseWriter
+	b             *bytes.Buffer
+	header        http.Header
+	status        int
+	wroteHeaders  bool
+	statusFilters []int
+	CreatedAt     time.Time
 }
 
 // Implementation of http.ResponseWriter
@@ -26,9 +26,11 @@ func (t *ResponseSaver) Header() http.Header {
 
 // Implementation of http.ResponseWriter
 func (t *ResponseSaver) WriteHeader(statusCode int) {
-	// do not write to underlying rw if status code equals filter
-	if statusCode == t.statusFilter {
-		t.rw = nil
+	// do not write to underlying rw if status code equals a filter
+	for _, filter := range t.statusFilters {
+		if statusCode == filter {
+			t.rw = nil
+		}
 	}
 	// remember that we wrote the headers
 	t.wroteHeaders = true
@@ -77,17 +79,15 @@ func (t *ResponseSaver) StatusCode() int {
 
 // NewResponseSaver returns a new ResponseSaver.
 // If rw is not nil, the response will be written (tee'd) to it in addition to saving to buffer.
-func NewResponseSaver(w http.ResponseWriter, statusFilter ...int) *ResponseSaver {
-	rs := &ResponseSaver{
-		CreatedAt: time.Now(),
-		rw:        w,
-		b:         &bytes.Buffer{},
-		header:    http.Header{},
-	}
-	if len(statusFilter) == 1 {
-		rs.statusFilter = statusFilter[0]
+// Responses with any of the given filter status codes are not written to rw.
+func NewResponseSaver(w http.ResponseWriter, statusFilters ...int) *ResponseSaver {
+	return &ResponseSaver{
+		CreatedAt:     time.Now(),
+		rw:            w,
+		b:             &bytes.Buffer{},
+		header:        http.Header{},
+		statusFilters: statusFilters,
 	}
-	return rs
 }
 
 func copyHeader(dst, src http.Header) {
@@ -0,0 +1,100 @@
+package static
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// File served for requests to directories.
+const indexFile = "index.html"
+
+// Cache-Control of the responses if not configured.
+const defaultCacheControl = "max-age=60"
+
+// Handler serves the files of a file system as an origin server.
+// Responses have a Last-Modified (if known), ETag (based on the file contents),
+// Content-Type and Cache-Control header, and conditional and range requests are supported.
+type Handler struct {
+	fsys         fs.FS
+	cacheControl string
+}
+
+// New creates a handler serving the file system with the given Cache-Control header,
+// e.g. `max-age=600`. Defaults to `max-age=60`.
+func New(fsys fs.FS, cacheControl string) *Handler {
+	if cacheControl == "" {
+		cacheControl = defaultCacheControl
+	}
+	return &Handler{
+		fsys:         fsys,
+		cacheControl: cacheControl,
+	}
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	name, content, modTime, err := h.read(r.URL.Path)
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrInvalid) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	hash := sha256.Sum256(content)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(hash[:16])+`"`)
+	w.Header().Set("Cache-Control", h.cacheControl)
+	http.ServeContent(w, r, name, modTime, bytes.NewReader(content))
+}
+
+// read returns the name, contents and modification time of the file for the URL path.
+// Directories are served by their index file.
+func (h *Handler) read(urlPath string) (string, []byte, time.Time, error) {
+	name := strings.TrimPrefix(path.Clean("/"+urlPath), "/")
+	if name == "" {
+		name = "."
+	}
+	info, err := fs.Stat(h.fsys, name)
+	if err != nil {
+		return "", nil, time.Time{}, err
+	}
+	if info.IsDir() {
+		name = path.Join(name, indexFile)
+		if info, err = fs.Stat(h.fsys, name); err != nil {
+			return "", nil, time.Time{}, err
+		}
+	}
+	f, err := h.fsys.Open(name)
+	if err != nil {
+		return "", nil, time.Time{}, err
+	}
+	defer f.Close()
+	content, err := io.ReadAll(f)
+	return name, content, info.ModTime(), err
+}
+
+// URIs returns the request URIs served by the file with the given name.
+// Index files are served for their directory as well.
+func URIs(name string) []string {
+	uris := []string{"/" + name}
+	if dir, file := path.Split(name); file == indexFile {
+		uris = append(uris, "/"+dir)
+		if dir != "" {
+			uris = append(uris, "/"+strings.TrimSuffix(dir, "/"))
+		}
+	}
+	return uris
+}
@@ -0,0 +1,91 @@
+package static
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	modTime := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+	h := New(fstest.MapFS{
+		"index.html":      {Data: []byte("<h1>Home</h1>"), ModTime: modTime},
+		"css/site.css":    {Data: []byte("body {}"), ModTime: modTime},
+		"docs/index.html": {Data: []byte("<h1>Docs</h1>")},
+	}, "max-age=600")
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "/css/site.css", nil))
+	etag := rr.Header().Get("ETag")
+	if rr.Code != http.StatusOK || rr.Body.String() != "body {}" || etag == "" ||
+		!strings.HasPrefix(rr.Header().Get("Content-Type"), "text/css") ||
+		rr.Header().Get("Cache-Control") != "max-age=600" ||
+		rr.Header().Get("Last-Modified") != "Sat, 01 Oct 2022 12:00:00 GMT" {
+		t.Fatalf("Response is %d %v", rr.Code, rr.Header())
+	}
+
+	req := httptest.NewRequest("GET", "/css/site.css", nil)
+	req.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotModified {
+		t.Fatalf("Status of conditional request is %d", rr.Code)
+	}
+
+	for path, expected := range map[string]string{"/": "<h1>Home</h1>", "/docs/": "<h1>Docs</h1>", "/docs": "<h1>Docs</h1>"} {
+		rr = httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Body.String() != expected || !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/html") {
+			t.Fatalf("Response for %s is %s", path, rr.Body.String())
+		}
+	}
+
+	for _, path := range []string{"/missing.html", "/css/"} {
+		rr = httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code != http.StatusNotFound {
+			t.Fatalf("Status for %s is %d", path, rr.Code)
+		}
+	}
+}
+
+func TestURIs(t *testing.T) {
+	if uris := strings.Join(URIs("docs/index.html"), " "); uris != "/docs/index.html /docs/ /docs" {
+		t.Fatalf("URIs are %s", uris)
+	}
+	if uris := strings.Join(URIs("index.html"), " "); uris != "/index.html /" {
+		t.Fatalf("URIs are %s", uris)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.html"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(dir, "b.html"), []byte("b"), 0644)
+
+	changes := make(chan []string, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go Watch(os.DirFS(dir), 20*time.Millisecond, func(names []string) {
+		changes <- names
+	}, done)
+	time.Sleep(50 * time.Millisecond)
+	os.WriteFile(filepath.Join(dir, "a.html"), []byte("changed"), 0644)
+	os.Remove(filepath.Join(dir, "b.html"))
+
+	select {
+	case names := <-changes:
+		sort.Strings(names)
+		if strings.Join(names, " ") != "a.html b.html" {
+			t.Fatalf("Changed files are %v", names)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("No changes detected")
+	}
+}
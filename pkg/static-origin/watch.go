@@ -0,0 +1,58 @@
+package static
+
+import (
+	"io/fs"
+	"time"
+)
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// Watch polls the file system at the given interval, calling changed with the names
+// of the files modified, added or removed since the previous poll. It returns when done is closed.
+func Watch(fsys fs.FS, interval time.Duration, changed func(names []string), done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	previous := snapshot(fsys)
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		current := snapshot(fsys)
+		names := make([]string, 0)
+		for name, state := range current {
+			if prev, found := previous[name]; !found || prev != state {
+				names = append(names, name)
+			}
+		}
+		for name := range previous {
+			if _, found := current[name]; !found {
+				names = append(names, name)
+			}
+		}
+		if len(names) > 0 {
+			changed(names)
+		}
+		previous = current
+	}
+}
+
+// snapshot returns the modification time and size of every file in the file system.
+// Files that cannot be read are left out.
+func snapshot(fsys fs.FS) map[string]fileState {
+	files := make(map[string]fileState)
+	fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			files[name] = fileState{modTime: info.ModTime(), size: info.Size()}
+		}
+		return nil
+	})
+	return files
+}
@@ -0,0 +1,206 @@
+package scheduler
+
+import (
+	"container/heap"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Minimum time before expiry to update an entry.
+// HTTP dates have a resolution of one second, so updating later than this
+// might result in the updated response being stale already.
+const minLead = time.Second
+
+// Scheduler keeps an in-memory priority queue of keys to update,
+// ordered by the time they should be updated at.
+// A pool of workers calls the update function for each key when it is due.
+//
+// Keys are unique in the queue: scheduling an already queued key reschedules it.
+type Scheduler struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	queue   updateQueue
+	items   map[string]*item
+	running int
+	stopped bool
+	workers sync.WaitGroup
+	// Fraction of the lifetime after which an entry is updated.
+	ahead float64
+	// Maximum fraction of the lifetime to randomly update earlier.
+	jitter float64
+	update func(key string)
+}
+
+// Stats describes the state of the update queue.
+type Stats struct {
+	// Number of keys waiting in the queue.
+	Depth int
+	// Number of updates currently running.
+	Running int
+	// How late the most overdue update in the queue is.
+	Lag time.Duration
+}
+
+type item struct {
+	key   string
+	at    time.Time
+	index int
+}
+
+// New creates a scheduler and starts the given number of workers.
+// Entries are updated after the `ahead` fraction of their lifetime has passed,
+// minus a random fraction of the lifetime up to `jitter`.
+func New(workers int, ahead, jitter float64, update func(key string)) *Scheduler {
+	s := &Scheduler{
+		items:  make(map[string]*item),
+		ahead:  ahead,
+		jitter: jitter,
+		update: update,
+	}
+	s.cond = sync.NewCond(&s.mutex)
+	s.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go s.work()
+	}
+	return s
+}
+
+// Stop stops the workers, waiting for the running updates to finish.
+// Keys still queued are not updated.
+func (s *Scheduler) Stop() {
+	s.mutex.Lock()
+	s.stopped = true
+	s.cond.Broadcast()
+	s.mutex.Unlock()
+	s.workers.Wait()
+}
+
+// Schedule queues the key for updating based on the lifetime of the stored entry,
+// i.e. the time it was received and the time it expires.
+// The entry is updated at least one second before it expires.
+// Entries without an expiration time are not scheduled.
+func (s *Scheduler) Schedule(key string, receivedAt, expires time.Time) {
+	if expires.IsZero() {
+		s.Remove(key)
+		return
+	}
+	ttl := expires.Sub(receivedAt)
+	at := receivedAt.Add(time.Duration(float64(ttl) * s.ahead))
+	if latest := expires.Add(-minLead); at.After(latest) {
+		at = latest
+	}
+	if s.jitter > 0 {
+		at = at.Add(-time.Duration(rand.Float64() * s.jitter * float64(ttl)))
+	}
+	s.ScheduleAt(key, at)
+}
+
+// ScheduleAt queues the key for updating at the given time.
+func (s *Scheduler) ScheduleAt(key string, at time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if it, ok := s.items[key]; ok {
+		it.at = at
+		heap.Fix(&s.queue, it.index)
+	} else {
+		it := &item{key: key, at: at}
+		heap.Push(&s.queue, it)
+		s.items[key] = it
+	}
+	s.cond.Broadcast()
+}
+
+// Remove removes the key from the queue, if it is queued.
+func (s *Scheduler) Remove(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if it, ok := s.items[key]; ok {
+		heap.Remove(&s.queue, it.index)
+		delete(s.items, key)
+	}
+}
+
+// Stats returns the current state of the queue.
+func (s *Scheduler) Stats() Stats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats := Stats{
+		Depth:   len(s.queue),
+		Running: s.running,
+	}
+	if len(s.queue) > 0 {
+		if lag := time.Since(s.queue[0].at); lag > 0 {
+			stats.Lag = lag
+		}
+	}
+	return stats
+}
+
+func (s *Scheduler) work() {
+	defer s.workers.Done()
+	for {
+		key, ok := s.next()
+		if !ok {
+			return
+		}
+		s.update(key)
+		s.mutex.Lock()
+		s.running--
+		s.mutex.Unlock()
+	}
+}
+
+// next blocks until a key is due for updating, and removes it from the queue.
+// It returns false once the scheduler is stopped.
+func (s *Scheduler) next() (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for {
+		if s.stopped {
+			return "", false
+		}
+		if len(s.queue) == 0 {
+			s.cond.Wait()
+			continue
+		}
+		wait := time.Until(s.queue[0].at)
+		if wait <= 0 {
+			it := heap.Pop(&s.queue).(*item)
+			delete(s.items, it.key)
+			s.running++
+			return it.key, true
+		}
+		timer := time.AfterFunc(wait, s.cond.Broadcast)
+		s.cond.Wait()
+		timer.Stop()
+	}
+}
+
+// updateQueue implements heap.Interface, ordered by update time.
+type updateQueue []*item
+
+func (q updateQueue) Len() int { return len(q) }
+
+func (q updateQueue) Less(i, j int) bool { return q[i].at.Before(q[j].at) }
+
+func (q updateQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *updateQueue) Push(x any) {
+	it := x.(*item)
+	it.index = len(*q)
+	*q = append(*q, it)
+}
+
+func (q *updateQueue) Pop() any {
+	old := *q
+	n := len(old)
+	it := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return it
+}
@@ -0,0 +1,98 @@
+package scheduler
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUpdatesInOrder(t *testing.T) {
+	var mutex sync.Mutex
+	updated := make([]string, 0)
+	s := New(1, 1, 0, func(key string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		updated = append(updated, key)
+	})
+	now := time.Now()
+	s.ScheduleAt("c", now.Add(300*time.Millisecond))
+	s.ScheduleAt("a", now.Add(100*time.Millisecond))
+	s.ScheduleAt("b", now.Add(200*time.Millisecond))
+	// reschedule an already queued key
+	s.ScheduleAt("a", now.Add(400*time.Millisecond))
+
+	if depth := s.Stats().Depth; depth != 3 {
+		t.Fatalf("Queue depth is %d, expected 3", depth)
+	}
+	time.Sleep(600 * time.Millisecond)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(updated) != 3 || updated[0] != "b" || updated[1] != "c" || updated[2] != "a" {
+		t.Fatalf("Updated %v", updated)
+	}
+}
+
+func TestScheduleAtFractionOfLifetime(t *testing.T) {
+	received := time.Now()
+	assertUpdatedAfter(t, New(1, 0.1, 0, nil), received, received.Add(4*time.Second), 400*time.Millisecond)
+}
+
+func TestScheduleBeforeExpiry(t *testing.T) {
+	received := time.Now()
+	assertUpdatedAfter(t, New(1, 1, 0, nil), received, received.Add(1400*time.Millisecond), 400*time.Millisecond)
+}
+
+// assertUpdatedAfter schedules an entry with the given lifetime,
+// and checks that it is updated after the expected duration.
+func assertUpdatedAfter(t *testing.T, s *Scheduler, received, expires time.Time, expected time.Duration) {
+	done := make(chan time.Time, 1)
+	s.update = func(key string) {
+		done <- time.Now()
+	}
+	s.Schedule("key", received, expires)
+
+	select {
+	case at := <-done:
+		if elapsed := at.Sub(received); elapsed < expected-50*time.Millisecond || elapsed > expected+100*time.Millisecond {
+			t.Fatalf("Updated after %s, expected %s", elapsed, expected)
+		}
+	case <-time.After(expected + time.Second):
+		t.Fatalf("Not updated")
+	}
+}
+
+func TestRemove(t *testing.T) {
+	s := New(1, 1, 0, func(key string) {
+		t.Fatalf("Removed key %s was updated", key)
+	})
+	s.ScheduleAt("key", time.Now().Add(100*time.Millisecond))
+	s.Remove("key")
+	if depth := s.Stats().Depth; depth != 0 {
+		t.Fatalf("Queue depth is %d, expected 0", depth)
+	}
+	time.Sleep(200 * time.Millisecond)
+}
+
+func TestStop(t *testing.T) {
+	started := make(chan struct{})
+	finished := false
+	s := New(2, 1, 0, func(key string) {
+		if key == "late" {
+			t.Errorf("Key %s was updated after stopping", key)
+			return
+		}
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		finished = true
+	})
+	now := time.Now()
+	s.ScheduleAt("running", now)
+	s.ScheduleAt("late", now.Add(100*time.Millisecond))
+	<-started
+	s.Stop()
+	if !finished {
+		t.Fatalf("Stop returned before the running update finished")
+	}
+	time.Sleep(200 * time.Millisecond)
+}
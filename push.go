@@ -0,0 +1,148 @@
+package alwayscache
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	tee "github.com/always-cache/always-cache/pkg/response-writer-tee"
+)
+
+// Maximum size of a push request body.
+const maxPushSize = 64 << 20
+
+// PushedResponse is a response pushed into the cache by the origin.
+type PushedResponse struct {
+	// Request URI (path and query) of the response.
+	URI string `json:"uri"`
+	// Request method. Defaults to GET.
+	Method string `json:"method,omitempty"`
+	// Request headers, i.e. the values of the headers listed in `Vary`
+	// and possibly the `Cache-Key` header.
+	RequestHeaders http.Header `json:"requestHeaders,omitempty"`
+	// Request body of POST requests as text, which is part of the cache key.
+	RequestBody string `json:"requestBody,omitempty"`
+	// Response status code. Defaults to 200.
+	Status int `json:"status,omitempty"`
+	// Response headers.
+	Headers http.Header `json:"headers"`
+	// Response body as text.
+	Body string `json:"body,omitempty"`
+	// Response body as base64, for binary content. Used instead of Body if set.
+	BodyBase64 string `json:"bodyBase64,omitempty"`
+}
+
+// PushResult tells whether a pushed response was stored.
+type PushResult struct {
+	URI    string `json:"uri"`
+	Stored bool   `json:"stored"`
+	Error  string `json:"error,omitempty"`
+}
+
+// servePush handles requests to the push endpoint.
+// The request body is a JSON array of pushed responses, which are stored
+// as if they had been fetched from the origin. The response is a JSON array of results.
+func (a *AlwaysCache) servePush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "PUT, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !a.pushAuthorized(r) {
+		a.log.Warn().Str("sourceIp", r.RemoteAddr).Msg("Unauthorized push request")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var pushed []PushedResponse
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPushSize)).Decode(&pushed); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid push request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	results := make([]PushResult, len(pushed))
+	storedUris := make([]string, 0, len(pushed))
+	for i, p := range pushed {
+		results[i] = PushResult{URI: p.URI}
+		if err := a.storePushed(p); err != nil {
+			results[i].Error = err.Error()
+		} else {
+			results[i].Stored = true
+			storedUris = append(storedUris, p.URI)
+		}
+	}
+	a.log.Info().Int("pushed", len(pushed)).Int("stored", len(storedUris)).Msg("Stored pushed responses")
+	// like fetched responses, pushed ones update the responses depending on them
+	go a.updateDependents(storedUris)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// pushAuthorized checks the bearer token of the push request.
+func (a *AlwaysCache) pushAuthorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if a.pushToken == "" || !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.pushToken)) == 1
+}
+
+// storePushed stores a pushed response via the same path as responses fetched from the origin.
+// The key is derived from the request like the key of a client request.
+// It returns an error if the response could not be stored, e.g. because it is not cacheable.
+func (a *AlwaysCache) storePushed(p PushedResponse) error {
+	method := p.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	if !strings.HasPrefix(p.URI, "/") {
+		return fmt.Errorf("URI must be a path: %s", p.URI)
+	}
+	var reqBody io.Reader
+	if p.RequestBody != "" {
+		reqBody = strings.NewReader(p.RequestBody)
+	}
+	req, err := http.NewRequest(method, p.URI, reqBody)
+	if err != nil {
+		return err
+	}
+	for name, values := range p.RequestHeaders {
+		req.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	req, cacheable := a.prepareRequest(req)
+	if !cacheable {
+		return fmt.Errorf("Responses to the request are not cached")
+	}
+	body := []byte(p.Body)
+	if p.BodyBase64 != "" {
+		if body, err = base64.StdEncoding.DecodeString(p.BodyBase64); err != nil {
+			return err
+		}
+	}
+	status := p.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	rw := tee.NewResponseSaver(nil)
+	for name, values := range p.Headers {
+		rw.Header()[http.CanonicalHeaderKey(name)] = values
+	}
+	if rw.Header().Get("Date") == "" {
+		rw.Header().Set("Date", rw.CreatedAt.UTC().Format(http.TimeFormat))
+	}
+	rw.WriteHeader(status)
+	rw.Write(body)
+
+	if cached, err := a.writeCache(rw, req); err != nil {
+		return err
+	} else if !cached {
+		return fmt.Errorf("Response must not be stored")
+	}
+	return nil
+}
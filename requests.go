@@ -0,0 +1,112 @@
+package alwayscache
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+
+	cachekey "github.com/always-cache/always-cache/pkg/cache-key"
+	"github.com/always-cache/always-cache/rfc9111"
+)
+
+// Maximum size of request bodies buffered in order to cache safe POST responses.
+// Larger bodies are streamed to the origin as is, and their responses are not cached.
+const maxRequestBodySize = 1 << 20
+
+// Request headers stored along with safe POST requests, in addition to the ones in the key.
+var replayedHeaders = []string{"Content-Type", "Content-Encoding"}
+
+// replayableMethods are the methods of requests that the updater is able to send again.
+// POST requests are replayed only if their response was marked safe and the request was stored.
+var replayableMethods = []string{http.MethodGet, http.MethodPost}
+
+// bufferBody reads the request body into memory, so that it can be sent to the origin
+// and stored for replaying later. Bodies larger than maxRequestBodySize are not buffered,
+// the already read part is streamed to the origin followed by the rest of the body.
+func bufferBody(r *http.Request) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return
+	}
+	buf, err := io.ReadAll(io.LimitReader(r.Body, maxRequestBodySize+1))
+	if err != nil || len(buf) > maxRequestBodySize {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+		return
+	}
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(buf))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+	r.ContentLength = int64(len(buf))
+}
+
+// hasUnbufferedBody checks if the request has a body that was too large to be buffered.
+// Responses to such requests are neither looked up nor stored, since the key cannot include the body.
+func hasUnbufferedBody(r *http.Request) bool {
+	return r.Method == http.MethodPost && r.GetBody == nil && r.ContentLength != 0
+}
+
+// storeRequest stores the request resulting in a safe POST response, so that the updater can replay it.
+// Requests with bodies that were not buffered are not stored.
+func (a *AlwaysCache) storeRequest(key string, req *http.Request, res *http.Response) {
+	if req.Method != http.MethodPost || req.GetBody == nil ||
+		!rfc9111.ParseCacheControl(res.Header.Values("Cache-Control")).HasDirective("safe") {
+		return
+	}
+	stored, err := a.keyer.GetRequestFromKey(key)
+	if err != nil {
+		a.log.Error().Err(err).Str("key", key).Msg("Could not create request for storing")
+		return
+	}
+	for _, name := range replayedHeaders {
+		if values := req.Header.Values(name); len(values) > 0 {
+			stored.Header[name] = values
+		}
+	}
+	if stored.Body, err = req.GetBody(); err != nil {
+		a.log.Error().Err(err).Str("key", key).Msg("Could not get request body for storing")
+		return
+	}
+	stored.ContentLength = req.ContentLength
+	var b bytes.Buffer
+	if err := stored.Write(&b); err != nil {
+		a.log.Error().Err(err).Str("key", key).Msg("Could not serialize request")
+		return
+	}
+	if err := a.cache.PutRequest(key, b.Bytes()); err != nil {
+		a.log.Error().Err(err).Str("key", key).Msg("Could not store request")
+	}
+}
+
+// requestFromKey returns the request to send to the origin in order to update the entry with the given key.
+// GET requests are rebuilt from the key, other requests are replayed from the stored request.
+// It returns cachekey.ErrorMethodNotSupported if the request cannot be replayed.
+func (a *AlwaysCache) requestFromKey(key string) (*http.Request, error) {
+	req, err := a.keyer.GetRequestFromKey(key)
+	if err != nil || req.Method == http.MethodGet {
+		return req, err
+	}
+	b, found, err := a.cache.GetRequest(key)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, cachekey.ErrorMethodNotSupported
+	}
+	stored, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		return nil, err
+	}
+	// the request is sent as a client request
+	stored.RequestURI = ""
+	bufferBody(stored)
+	if a.isGraphQL(stored) {
+		// the key of the stored request is derived from the normalized query
+		stored, _ = a.prepareGraphQL(stored)
+	}
+	return stored, nil
+}
@@ -0,0 +1,114 @@
+package alwayscache
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/always-cache/always-cache/rfc9111"
+)
+
+const (
+	// Delay before the first retry of a failed update, doubled for each attempt.
+	retryBaseDelay = time.Second
+	// Maximum delay between update retries.
+	retryMaxDelay = 5 * time.Minute
+)
+
+// retryState keeps track of entries for which updates are failing.
+// These entries may be served stale until the maximum staleness is reached.
+type retryState struct {
+	mutex    sync.Mutex
+	attempts map[string]int
+}
+
+func newRetryState() *retryState {
+	return &retryState{
+		attempts: make(map[string]int),
+	}
+}
+
+// failed registers a failed update and returns the number of failed attempts so far.
+func (r *retryState) failed(key string) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.attempts[key]++
+	return r.attempts[key]
+}
+
+// succeeded clears the failures of the key.
+func (r *retryState) succeeded(key string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.attempts, key)
+}
+
+// failing returns true if the latest update of the key failed.
+func (r *retryState) failing(key string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.attempts[key] > 0
+}
+
+// transientFailureStatusCodes are origin response status codes that indicate a failure
+// that might go away by itself, i.e. the request is worth retrying.
+var transientFailureStatusCodes = []int{
+	http.StatusRequestTimeout,
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// isTransientFailure checks if the origin response status code indicates a transient failure.
+// Zero is included since it means the origin did not respond at all.
+func isTransientFailure(statusCode int) bool {
+	if statusCode == 0 {
+		return true
+	}
+	for _, code := range transientFailureStatusCodes {
+		if statusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// isGone checks if the origin response status code is an authoritative answer
+// that the resource does not exist anymore.
+func isGone(statusCode int) bool {
+	return statusCode == http.StatusNotFound || statusCode == http.StatusGone
+}
+
+// retryDelay returns the delay before the given retry attempt.
+// The delay grows exponentially, but a longer `Retry-After` from the origin is honored.
+func retryDelay(attempt int, retryAfter string) time.Duration {
+	delay := retryMaxDelay
+	if attempt <= 16 {
+		delay = retryBaseDelay << (attempt - 1)
+	}
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	if after := parseRetryAfter(retryAfter); after > delay {
+		delay = after
+	}
+	return delay
+}
+
+// parseRetryAfter parses the `Retry-After` header value, which is either
+// a number of seconds or an HTTP date. It returns zero if the value is invalid.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := rfc9111.HttpDate(value); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
@@ -0,0 +1,21 @@
+package alwayscache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	if d := retryDelay(1, ""); d != retryBaseDelay {
+		t.Fatalf("First retry delay is %s", d)
+	}
+	if d := retryDelay(3, ""); d != 4*retryBaseDelay {
+		t.Fatalf("Third retry delay is %s", d)
+	}
+	if d := retryDelay(100, ""); d != retryMaxDelay {
+		t.Fatalf("Retry delay is %s, expected maximum", d)
+	}
+	if d := retryDelay(1, "120"); d != 2*time.Minute {
+		t.Fatalf("Retry delay with Retry-After is %s", d)
+	}
+}
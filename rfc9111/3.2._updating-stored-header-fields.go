@@ -1,5 +1,7 @@
 package rfc9111
 
+import "net/http"
+
 // §  3.2.  Updating Stored Header Fields
 // §
 // §     Caches are required to update a stored response's header fields from
@@ -19,6 +21,15 @@ package rfc9111
 // §        recipient, as described below, and
 // §
 // §     *  The Content-Length header field.
+func updateStoredHeader(stored http.Header, received http.Header) {
+	for name, values := range storableHeader(received) {
+		if http.CanonicalHeaderKey(name) == "Content-Length" {
+			continue
+		}
+		stored[name] = append([]string(nil), values...)
+	}
+}
+
 // §
 // §     In some cases, caches (especially in user agents) store the results
 // §     of processing the received response, rather than the response itself,
@@ -14,6 +14,11 @@ func GetExpiration(res *http.Response) time.Time {
 	return time.Time{}
 }
 
+// FreshnessLifetime returns the freshness lifetime of the response, as declared by the origin.
+func FreshnessLifetime(res *http.Response) time.Duration {
+	return freshness_lifetime(res)
+}
+
 // §  4.2.1.  Calculating Freshness Lifetime
 // §
 func freshness_lifetime(res *http.Response) time.Duration {
@@ -19,11 +19,12 @@ func generateConditionalRequest(req *http.Request, res *http.Response) (*http.Re
 		return nil, err
 	}
 	if req != nil {
-		downstreamReq.Header = req.Header
+		// the request being satisfied must not get the precondition header fields
+		downstreamReq.Header = req.Header.Clone()
 	} else {
 		for _, varyField := range GetListHeader(res.Header, "Vary") {
 			for _, value := range res.Request.Header.Values(varyField) {
-				req.Header.Add(varyField, value)
+				downstreamReq.Header.Add(varyField, value)
 			}
 		}
 	}
@@ -0,0 +1,37 @@
+package rfc9111
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestValidationRequestFromStoredResponse(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/page", nil)
+	req.Header.Set("Accept-Language", "fi")
+	req.Header.Set("User-Agent", "test")
+	res := &http.Response{
+		StatusCode: 200,
+		Header: http.Header{
+			"Etag":          []string{`"abc"`},
+			"Last-Modified": []string{"Tue, 22 Feb 2022 22:22:22 GMT"},
+			"Vary":          []string{"Accept-Language"},
+		},
+		Request: req,
+	}
+	validationReq, err := ValidationRequest(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inm := validationReq.Header.Get("If-None-Match"); inm != `"abc"` {
+		t.Fatalf("If-None-Match is %s", inm)
+	}
+	if ims := validationReq.Header.Get("If-Modified-Since"); ims != "Tue, 22 Feb 2022 22:22:22 GMT" {
+		t.Fatalf("If-Modified-Since is %s", ims)
+	}
+	if al := validationReq.Header.Get("Accept-Language"); al != "fi" {
+		t.Fatalf("Accept-Language is %s", al)
+	}
+	if ua := validationReq.Header.Get("User-Agent"); ua != "" {
+		t.Fatalf("Non-vary header User-Agent included: %s", ua)
+	}
+}
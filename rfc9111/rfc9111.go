@@ -82,6 +82,13 @@ func MustNotReuse(
 	return fwdReason, validationRequest, nil
 }
 
+// VaryHeadersMatch checks if the request header fields nominated by the Vary header of the stored response
+// match those of the request that resulted in the stored response, regardless of freshness.
+// The Request field of the stored response must be set.
+func VaryHeadersMatch(clientRequest *http.Request, storedResponse *http.Response) bool {
+	return headerFieldsMatch(clientRequest, storedResponse.Request, storedResponse)
+}
+
 // AddAgeHeader adds the Age header to the response, as mandated by the standard.
 // It directly mutates the response headers.
 // It is based on the `current_age` calculation.
@@ -89,3 +96,22 @@ func AddAgeHeader(storedResponse *http.Response, responseTime, requestTime time.
 	age := current_age(storedResponse, responseTime, requestTime)
 	storedResponse.Header.Set("Age", toDeltaSeconds(age))
 }
+
+// ValidationRequest returns a conditional request for validating a stored response,
+// e.g. when the cache is updating the response independently of any client request.
+// The request is synthesized from the request that resulted in the stored response,
+// and thus the Request field of the response must be set.
+// WARNING: The validation request does not include scheme and host!
+func ValidationRequest(storedResponse *http.Response) (*http.Request, error) {
+	if storedResponse.Request == nil {
+		return nil, fmt.Errorf("Response request object empty")
+	}
+	return generateConditionalRequest(nil, storedResponse)
+}
+
+// FreshenStoredResponse updates the header fields of a stored response with the ones
+// received in a 304 (Not Modified) response to a validation request.
+// It directly mutates the stored response headers.
+func FreshenStoredResponse(storedResponse *http.Response, notModified *http.Response) {
+	updateStoredHeader(storedResponse.Header, notModified.Header)
+}
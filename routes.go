@@ -0,0 +1,120 @@
+package alwayscache
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/always-cache/always-cache/cache"
+
+	"github.com/rs/zerolog"
+)
+
+// Route maps requests with the given path prefix to an origin.
+type Route struct {
+	// Path prefix of requests sent to the origin, e.g. `/api/`.
+	PathPrefix string
+	// Remove the path prefix before forwarding requests to the origin.
+	// A base path of the origin URL is added in any case.
+	StripPrefix bool
+	// Origin configuration. The Cache is set to the shared storage.
+	// The origin URL and path prefix are used as the origin identifier in cache keys if OriginId is not set,
+	// so that keys are unique for each route.
+	Config Config
+}
+
+type RoutesConfig struct {
+	// Storage shared by the cache entries of all routes.
+	Cache cache.CacheProvider
+	// Routes to the origins. The route with the longest matching path prefix is used.
+	Routes []Route
+	// Logger to use. The global zerolog logger is used if nil.
+	Logger *zerolog.Logger
+}
+
+// Routes routes requests by path prefix to the always-cache instances of different origins.
+// Each origin has its own cache keys, updater, transport and policy.
+type Routes struct {
+	routes  []routeCache
+	storage cache.CacheProvider
+	log     zerolog.Logger
+}
+
+type routeCache struct {
+	prefix string
+	cache  *AlwaysCache
+}
+
+// CreateRoutes initializes an always-cache instance for each route.
+func CreateRoutes(config RoutesConfig) (*Routes, error) {
+	var logger zerolog.Logger
+	if config.Logger == nil {
+		logger = zerolog.New(zerolog.NewConsoleWriter())
+	} else {
+		logger = *config.Logger
+	}
+
+	rs := &Routes{storage: config.Cache, log: logger}
+	originIds := make(map[string]string, len(config.Routes))
+	for _, route := range config.Routes {
+		if !strings.HasPrefix(route.PathPrefix, "/") {
+			return nil, fmt.Errorf("Route path prefix must start with /: %s", route.PathPrefix)
+		}
+		routeConfig := route.Config
+		if routeConfig.OriginId == "" {
+			routeConfig.OriginId = routeConfig.OriginURL.String() + route.PathPrefix
+		}
+		if other, found := originIds[routeConfig.OriginId]; found {
+			return nil, fmt.Errorf("Routes %s and %s have the same origin identifier", other, route.PathPrefix)
+		}
+		originIds[routeConfig.OriginId] = route.PathPrefix
+		if route.StripPrefix {
+			routeConfig.StripPrefix = route.PathPrefix
+		}
+		routeConfig.Cache = config.Cache
+		if routeConfig.Logger == nil {
+			routeLogger := logger.With().Str("route", route.PathPrefix).Logger()
+			routeConfig.Logger = &routeLogger
+		}
+		rs.routes = append(rs.routes, routeCache{
+			prefix: route.PathPrefix,
+			cache:  CreateCache(routeConfig),
+		})
+	}
+	// longest prefixes first
+	sort.SliceStable(rs.routes, func(i, j int) bool {
+		return len(rs.routes[i].prefix) > len(rs.routes[j].prefix)
+	})
+	return rs, nil
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (rs *Routes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a, found := rs.Route(r.URL.Path); found {
+		a.ServeHTTP(w, r)
+		return
+	}
+	rs.log.Debug().Str("url", r.URL.String()).Msg("No route for request")
+	http.NotFound(w, r)
+}
+
+// Route returns the always-cache instance of the route matching the given path, if any.
+func (rs *Routes) Route(path string) (*AlwaysCache, bool) {
+	for _, route := range rs.routes {
+		if strings.HasPrefix(path, route.prefix) {
+			return route.cache, true
+		}
+	}
+	return nil, false
+}
+
+// Close stops the always-cache instances of all routes and closes the shared cache storage.
+func (rs *Routes) Close() {
+	for _, route := range rs.routes {
+		route.cache.stop()
+	}
+	if err := rs.storage.Close(); err != nil {
+		rs.log.Error().Err(err).Msg("Could not close cache")
+	}
+}
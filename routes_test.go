@@ -0,0 +1,68 @@
+package alwayscache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/always-cache/always-cache/cache"
+)
+
+func TestRoutes(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Cache-Control", "max-age=60")
+		w.Write([]byte(r.URL.EscapedPath()))
+	})
+	server := http.Server{Addr: ":9022", Handler: mux}
+	go server.ListenAndServe()
+	defer server.Shutdown(context.Background())
+
+	apiURL, _ := url.Parse("http://localhost:9022/v1")
+	assetsURL, _ := url.Parse("http://localhost:9022")
+	rs, err := CreateRoutes(RoutesConfig{
+		Cache: cache.NewSQLiteCache(""),
+		Routes: []Route{
+			{PathPrefix: "/static/", Config: Config{OriginURL: *assetsURL}},
+			{PathPrefix: "/api/", StripPrefix: true, Config: Config{OriginURL: *apiURL}},
+			{PathPrefix: "/api/legacy/", StripPrefix: true, Config: Config{OriginURL: *assetsURL}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 200)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		rs.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		time.Sleep(time.Millisecond * 100)
+		return rr
+	}
+	cases := map[string]string{
+		"/static/app.css":      "/static/app.css",
+		"/api/items":           "/v1/items",
+		"/api/legacy/items":    "/items",
+		"/api/items%2Fescaped": "/v1/items%2Fescaped",
+	}
+	for path, expected := range cases {
+		if rr := get(path); rr.Body.String() != expected {
+			t.Fatalf("Origin path for %s is %s", path, rr.Body.String())
+		}
+	}
+	if rr := get("/api/items"); !strings.Contains(rr.Header().Get("Cache-Status"), "hit") {
+		t.Fatalf("Cache-Status is %s", rr.Header().Get("Cache-Status"))
+	}
+	if rr := get("/other"); rr.Code != http.StatusNotFound {
+		t.Fatalf("Status without route is %d", rr.Code)
+	}
+
+	api, _ := rs.Route("/api/items")
+	if stats, _ := api.Stats(); len(stats) != 2 {
+		t.Fatalf("API route has %d entries", len(stats))
+	}
+}
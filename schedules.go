@@ -0,0 +1,165 @@
+package alwayscache
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/always-cache/always-cache/pkg/cron"
+)
+
+// Number of past schedule runs kept in memory.
+const maxScheduleRuns = 100
+
+// RefreshSchedule refreshes a group of URIs at the times given by a cron expression,
+// regardless of when the stored responses expire.
+type RefreshSchedule struct {
+	// Name of the schedule, used in logs. Defaults to the cron expression.
+	Name string
+	// Cron expression with five fields: minute, hour, day of month, month and day of week.
+	// Macros such as `@hourly` and `@daily` are supported as well.
+	Cron string
+	// Request URIs (path and query) to refresh.
+	// A URI ending with `*` refreshes all stored responses with URIs starting with the prefix.
+	// All stored variants of a URI are refreshed. URIs not stored yet are fetched and stored.
+	URIs []string
+}
+
+// ScheduleRun is the result of a single run of a refresh schedule.
+type ScheduleRun struct {
+	Name      string
+	StartedAt time.Time
+	Duration  time.Duration
+	// Number of responses fetched from the origin.
+	Refreshed int
+	// Number of responses that could not be fetched or stored.
+	Failed int
+}
+
+// scheduleRuns keeps a log of the latest schedule runs.
+type scheduleRuns struct {
+	mutex sync.Mutex
+	runs  []ScheduleRun
+}
+
+func (s *scheduleRuns) add(run ScheduleRun) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.runs = append(s.runs, run)
+	if len(s.runs) > maxScheduleRuns {
+		s.runs = s.runs[len(s.runs)-maxScheduleRuns:]
+	}
+}
+
+// ScheduleRuns returns the latest runs of the refresh schedules, oldest first.
+func (a *AlwaysCache) ScheduleRuns() []ScheduleRun {
+	a.scheduleRuns.mutex.Lock()
+	defer a.scheduleRuns.mutex.Unlock()
+	return append([]ScheduleRun(nil), a.scheduleRuns.runs...)
+}
+
+// startSchedules starts a goroutine for each valid refresh schedule.
+// Invalid schedules are logged and ignored.
+func (a *AlwaysCache) startSchedules(schedules []RefreshSchedule) {
+	for _, s := range schedules {
+		c, err := cron.Parse(s.Cron)
+		if err != nil {
+			a.log.Error().Err(err).Str("schedule", s.Name).Msg("Invalid refresh schedule, ignoring")
+			continue
+		}
+		if s.Name == "" {
+			s.Name = s.Cron
+		}
+		go a.runSchedule(s, c)
+	}
+}
+
+// runSchedule refreshes the URIs of the schedule each time the cron expression matches,
+// until the instance is closed.
+func (a *AlwaysCache) runSchedule(s RefreshSchedule, c cron.Schedule) {
+	for {
+		next := c.Next(time.Now())
+		if next.IsZero() {
+			a.log.Warn().Str("schedule", s.Name).Msg("Refresh schedule never runs again")
+			return
+		}
+		select {
+		case <-a.done:
+			return
+		case <-time.After(time.Until(next)):
+		}
+		a.refreshSchedule(s)
+	}
+}
+
+// refreshSchedule fetches and stores the responses targeted by the schedule,
+// running at most the configured number of fetches concurrently.
+func (a *AlwaysCache) refreshSchedule(s RefreshSchedule) ScheduleRun {
+	run := ScheduleRun{Name: s.Name, StartedAt: time.Now()}
+	keys := a.scheduleKeys(s.URIs)
+
+	var failed atomic.Int64
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, a.scheduleConcurrency)
+	for _, key := range keys {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(key string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			req, err := a.keyer.GetRequestFromKey(key)
+			if err != nil {
+				a.log.Error().Err(err).Str("key", key).Msg("Could not create request for scheduled refresh")
+				failed.Add(1)
+				return
+			}
+			if cached, err := a.saveRequest(req, key); err != nil || !cached {
+				a.log.Warn().Err(err).Str("key", key).Str("schedule", s.Name).Msg("Could not refresh scheduled entry")
+				failed.Add(1)
+			}
+		}(key)
+	}
+	wg.Wait()
+
+	run.Duration = time.Since(run.StartedAt)
+	run.Failed = int(failed.Load())
+	run.Refreshed = len(keys) - run.Failed
+	a.scheduleRuns.add(run)
+	a.log.Info().
+		Str("schedule", s.Name).
+		Int("refreshed", run.Refreshed).
+		Int("failed", run.Failed).
+		Dur("duration", run.Duration).
+		Msg("Ran refresh schedule")
+	return run
+}
+
+// scheduleKeys returns the keys of the entries to refresh for the given URIs.
+// URIs without stored responses are refreshed using the key without variants.
+func (a *AlwaysCache) scheduleKeys(uris []string) []string {
+	keys := make([]string, 0)
+	for _, uri := range uris {
+		if strings.HasSuffix(uri, "*") {
+			prefix := a.keyer.MethodPrefix("GET") + strings.TrimSuffix(uri, "*")
+			a.cache.AllKeys(prefix, func(key string) {
+				keys = append(keys, key)
+			})
+			continue
+		}
+		req, err := http.NewRequest("GET", uri, nil)
+		if err != nil {
+			a.log.Error().Err(err).Str("uri", uri).Msg("Could not create request for scheduled refresh")
+			continue
+		}
+		if variants := a.variantKeys(req); len(variants) > 0 {
+			keys = append(keys, variants...)
+		} else {
+			keys = append(keys, a.keyer.GetKeyPrefix(req))
+		}
+	}
+	return keys
+}
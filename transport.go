@@ -0,0 +1,89 @@
+package alwayscache
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"time"
+)
+
+// OriginTransport configures the connections to the origin.
+// Zero values use the defaults of http.DefaultTransport.
+type OriginTransport struct {
+	// Timeout for establishing connections. Defaults to 30 seconds.
+	DialTimeout time.Duration
+	// Timeout for TLS handshakes. Defaults to 10 seconds.
+	TLSHandshakeTimeout time.Duration
+	// Time to wait for the response headers after the request has been sent. No limit by default.
+	ResponseHeaderTimeout time.Duration
+	// How long idle connections are kept open. Defaults to 90 seconds.
+	IdleConnTimeout time.Duration
+	// Maximum number of idle connections kept open. Defaults to 100.
+	MaxIdleConns int
+	// Maximum number of idle connections per origin server. Defaults to 2.
+	MaxIdleConnsPerHost int
+	// Maximum number of connections per origin server, including active ones. No limit by default.
+	MaxConnsPerHost int
+	// Do not use HTTP/2 with TLS origins. By default it is used if the origin supports it.
+	DisableHTTP2 bool
+	// Certificate authorities trusted for origin certificates, e.g. an internal CA.
+	// The system roots are used if not set.
+	RootCAs *x509.CertPool
+	// Client certificates presented to the origin, for mutual TLS.
+	Certificates []tls.Certificate
+	// Accept any origin certificate. Only meant for testing, never use in production.
+	InsecureSkipVerify bool
+}
+
+// transport returns a transport for the origin, verifying the origin certificate for the server name if set.
+// Proxy settings are taken from the environment, like for http.DefaultTransport.
+func (c OriginTransport) transport(serverName string) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = c.dialer().DialContext
+	if c.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = c.TLSHandshakeTimeout
+	}
+	transport.ResponseHeaderTimeout = c.ResponseHeaderTimeout
+	if c.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = c.IdleConnTimeout
+	}
+	if c.MaxIdleConns > 0 {
+		transport.MaxIdleConns = c.MaxIdleConns
+	}
+	transport.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+	transport.MaxConnsPerHost = c.MaxConnsPerHost
+	transport.TLSClientConfig = &tls.Config{
+		ServerName:         serverName,
+		RootCAs:            c.RootCAs,
+		Certificates:       c.Certificates,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.DisableHTTP2 {
+		// a non-nil empty map disables HTTP/2
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return transport
+}
+
+// dialer returns the dialer for connections to the origin.
+func (c OriginTransport) dialer() *net.Dialer {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if c.DialTimeout > 0 {
+		dialer.Timeout = c.DialTimeout
+	}
+	return dialer
+}
+
+// unixTransport returns a transport sending all requests to the HTTP server listening on the Unix socket.
+func (c OriginTransport) unixTransport(socket string) *http.Transport {
+	transport := c.transport("")
+	transport.Proxy = nil
+	dialer := c.dialer()
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "unix", socket)
+	}
+	return transport
+}
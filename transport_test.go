@@ -0,0 +1,88 @@
+package alwayscache
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/always-cache/always-cache/cache"
+)
+
+// clientCertificate creates a self-signed client certificate.
+func clientCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "always-cache"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestOriginTransport(t *testing.T) {
+	clientCert := clientCertificate(t)
+	clientCAs := x509.NewCertPool()
+	leaf, _ := x509.ParseCertificate(clientCert.Certificate[0])
+	clientCAs.AddCert(leaf)
+
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte(r.Proto))
+	}))
+	origin.EnableHTTP2 = true
+	origin.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	origin.StartTLS()
+	defer origin.Close()
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(origin.Certificate())
+	originURL, _ := url.Parse(origin.URL)
+
+	get := func(transport OriginTransport) *httptest.ResponseRecorder {
+		mw := CreateCache(Config{
+			Cache:           cache.NewSQLiteCache(""),
+			OriginURL:       *originURL,
+			OriginTransport: transport,
+			DisableUpdates:  true,
+		})
+		rr := httptest.NewRecorder()
+		mw.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+		return rr
+	}
+
+	if rr := get(OriginTransport{RootCAs: rootCAs, Certificates: []tls.Certificate{clientCert}}); rr.Code != http.StatusOK || rr.Body.String() != "HTTP/2.0" {
+		t.Fatalf("Response is %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := get(OriginTransport{RootCAs: rootCAs, Certificates: []tls.Certificate{clientCert}, DisableHTTP2: true}); rr.Body.String() != "HTTP/1.1" {
+		t.Fatalf("Response without HTTP/2 is %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := get(OriginTransport{RootCAs: rootCAs}); rr.Code != http.StatusBadGateway {
+		t.Fatalf("Status without client certificate is %d", rr.Code)
+	}
+	if rr := get(OriginTransport{Certificates: []tls.Certificate{clientCert}}); rr.Code != http.StatusBadGateway {
+		t.Fatalf("Status with untrusted origin certificate is %d", rr.Code)
+	}
+	if rr := get(OriginTransport{Certificates: []tls.Certificate{clientCert}, InsecureSkipVerify: true}); rr.Code != http.StatusOK {
+		t.Fatalf("Status when skipping verification is %d", rr.Code)
+	}
+}
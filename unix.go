@@ -0,0 +1,31 @@
+package alwayscache
+
+import (
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+)
+
+// ListenUnix listens on the Unix socket at the given path, with the given file permissions.
+// A socket file left over from a previous run is removed first, unless a server is still listening on it.
+func ListenUnix(path string, mode fs.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&fs.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("Socket %s is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
@@ -0,0 +1,55 @@
+package alwayscache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/always-cache/always-cache/cache"
+)
+
+func TestUnixSocketOrigin(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "app.sock")
+	l, err := ListenUnix(socket, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(socket); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("Socket permissions are %v (%v)", info.Mode(), err)
+	}
+	calls := 0
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte(r.Host + " " + r.URL.RequestURI()))
+	})}
+	go server.Serve(l)
+	defer server.Close()
+
+	if _, err := ListenUnix(socket, 0600); err == nil {
+		t.Fatalf("Listening on a socket in use succeeded")
+	}
+
+	originURL, _ := url.Parse("unix://" + socket)
+	mw := CreateCache(Config{Cache: cache.NewSQLiteCache(""), OriginURL: *originURL, DisableUpdates: true})
+	get := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/page?x=1", nil)
+		req.Host = "app.example"
+		rr := httptest.NewRecorder()
+		mw.ServeHTTP(rr, req)
+		time.Sleep(time.Millisecond * 100)
+		return rr
+	}
+
+	if rr := get(); rr.Code != http.StatusOK || rr.Body.String() != "app.example /page?x=1" {
+		t.Fatalf("Response is %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := get(); !strings.Contains(rr.Header().Get("Cache-Status"), "hit") || calls != 1 {
+		t.Fatalf("Response is not stored (%s), %d calls", rr.Header().Get("Cache-Status"), calls)
+	}
+}
@@ -1,123 +1,418 @@
 package alwayscache
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
 	"net/http"
+	"net/textproto"
+	"strings"
 	"time"
 
+	"github.com/always-cache/always-cache/cache"
 	cachekey "github.com/always-cache/always-cache/pkg/cache-key"
 	"github.com/always-cache/always-cache/pkg/cache-update"
 	tee "github.com/always-cache/always-cache/pkg/response-writer-tee"
+	scheduler "github.com/always-cache/always-cache/pkg/update-scheduler"
 	"github.com/always-cache/always-cache/rfc9111"
 )
 
+// How often the state of the update queue, origin budget and origin pool is logged.
+const statsLogInterval = time.Minute
+
 func (a *AlwaysCache) updateIfNeeded(downReq *http.Request, upRes *http.Response) {
-	if a.updateTimeout == 0 {
-		a.invalidateUris(
-			rfc9111.GetInvalidateURIs(downReq, upRes))
+	invalidateUris := rfc9111.GetInvalidateURIs(downReq, upRes)
+	if a.updater == nil {
+		a.invalidateUris(invalidateUris)
 	} else {
-		a.revalidateUris(
-			rfc9111.GetInvalidateURIs(downReq, upRes))
+		a.revalidateUris(invalidateUris)
 	}
-	a.saveUpdates(
-		cacheupdate.GetCacheUpdates(downReq, upRes))
+	updates := cacheupdate.GetCacheUpdates(downReq, upRes)
+	a.saveUpdates(downReq, updates)
+
+	// responses depending on the updated URIs need to be updated as well
+	// delayed updates are handled when they are run
+	uris := invalidateUris
+	for _, update := range updates {
+		if !update.Pattern && update.Delay == 0 {
+			uris = append(uris, update.URI)
+		}
+	}
+	a.updateDependents(uris)
 }
 
-func (a *AlwaysCache) saveUpdates(updates []cacheupdate.CacheUpdate) {
+// saveUpdates updates the cache based on the `Cache-Update` entries of a response.
+// Delayed updates are queued as jobs, which are persisted in order to survive restarts.
+func (a *AlwaysCache) saveUpdates(downReq *http.Request, updates []cacheupdate.CacheUpdate) {
+	source := downReq.Method + " " + downReq.URL.RequestURI()
 	for _, update := range updates {
-		a.log.Trace().Str("update", update.Path).Msgf("Updating cache based on header")
-		updateCache := func() {
-			req, err := http.NewRequest("GET", update.Path, nil)
-			if err != nil {
-				a.log.Error().Err(err).Str("path", update.Path).Msg("Could not create request for updates")
-				return
+		a.log.Trace().Str("update", update.URI).Str("mode", string(update.Mode)).Msgf("Updating cache based on header")
+		if update.Pattern {
+			a.saveMatchingUpdates(update, source)
+			continue
+		}
+		req, err := http.NewRequest("GET", update.URI, nil)
+		if err != nil {
+			a.log.Error().Err(err).Str("uri", update.URI).Msg("Could not create request for updates")
+			continue
+		}
+		key := a.keyer.GetKeyPrefix(req)
+		// stored safe POST responses are targeted as well
+		postKeys := a.postKeys(update.URI)
+		if update.Mode == cacheupdate.ModePurge {
+			a.purgePrefix(key)
+			for _, key := range postKeys {
+				a.cache.Purge(key)
 			}
-			_, err = a.saveRequest(req, a.keyer.GetKeyPrefix(req))
-			if err != nil {
-				a.log.Error().Err(err).Str("path", update.Path).Msg("Could not save updates")
-				return
+			continue
+		}
+		// update all stored variants, or fetch the bare request if nothing is stored
+		keys := a.variantKeys(req)
+		if len(keys) == 0 {
+			keys = append(keys, key)
+		}
+		keys = append(keys, postKeys...)
+		for _, key := range keys {
+			if update.Delay > 0 {
+				a.queueUpdate(key, update.Delay, source)
+			} else {
+				a.updateEntry(key)
 			}
 		}
-		if update.Delay > 0 {
-			go func() {
-				time.Sleep(update.Delay)
-				updateCache()
-			}()
+	}
+}
+
+// saveMatchingUpdates applies a pattern update to all stored GET and POST responses matching the pattern.
+// Only the keys starting with the literal part of the pattern are considered.
+// Purges are done immediately, regardless of any delay.
+func (a *AlwaysCache) saveMatchingUpdates(update cacheupdate.CacheUpdate, source string) {
+	keys := make([]string, 0)
+	for _, method := range replayableMethods {
+		a.cache.AllKeys(a.keyer.MethodPrefix(method)+update.Prefix(), func(key string) {
+			if req, err := a.keyer.GetRequestFromKey(key); err == nil && update.Matches(req.URL.RequestURI()) {
+				keys = append(keys, key)
+			}
+		})
+	}
+	a.log.Debug().Str("update", update.URI).Int("matches", len(keys)).Msg("Updating stored responses matching pattern")
+	for _, key := range keys {
+		if update.Mode == cacheupdate.ModePurge {
+			a.cache.Purge(key)
+		} else if update.Delay > 0 {
+			a.queueUpdate(key, update.Delay, source)
 		} else {
-			updateCache()
+			a.updateEntry(key)
 		}
 	}
 }
 
-// updateCache runs an infinite loop to update the cache,
-// one entry at a time.
-// It assumes that the cache key equals the request URL.
-// It will query the cache for entries expiring within the update timeout.
-// If it finds one, it will update the cache for that entry.
-// If it does not find any, it will sleep for the duration of the update timeout.
-func (a *AlwaysCache) updateCache() {
-	a.log.Info().Msgf("Starting cache update loop with timeout %s", a.updateTimeout)
+// purgePrefix purges all stored responses with the given key prefix.
+func (a *AlwaysCache) purgePrefix(prefix string) {
+	keys := make([]string, 0)
+	a.cache.AllKeys(prefix, func(key string) {
+		keys = append(keys, key)
+	})
+	for _, key := range keys {
+		a.cache.Purge(key)
+	}
+}
+
+// startUpdates queues all stored entries for updating before they expire.
+// Only GET and (safe) POST requests are updated, since other methods cannot be replayed.
+func (a *AlwaysCache) startUpdates() {
+	a.log.Info().Msg("Starting cache updates")
+	for _, method := range replayableMethods {
+		a.cache.AllExpiring(a.keyer.MethodPrefix(method), a.scheduleUpdate)
+	}
+}
+
+// logStats periodically logs the state of the update queue, the origin budget
+// and the origin pool members until the instance is closed.
+func (a *AlwaysCache) logStats() {
+	ticker := time.NewTicker(statsLogInterval)
+	defer ticker.Stop()
 	for {
-		key, expiry, err := a.cache.Oldest(a.keyer.MethodPrefix("GET"))
-		// if error, try again in 1 minute
-		if err != nil {
-			a.log.Error().Err(err).Msg("Could not get oldest entry")
-			time.Sleep(a.updateTimeout)
-			continue
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
 		}
-		// if expiring within 1 minute, update
-		// else sleep for 1 minute
-		if key != "" && expiry.Sub(time.Now()) <= a.updateTimeout {
-			a.updateEntry(key)
-		} else {
-			time.Sleep(a.updateTimeout)
+		if a.updater != nil {
+			stats := a.updater.Stats()
+			a.log.Debug().
+				Int("depth", stats.Depth).
+				Int("running", stats.Running).
+				Dur("lag", stats.Lag).
+				Msg("Update queue")
+		}
+		budgetStats := a.budget.Stats()
+		a.log.Debug().
+			Int("inFlight", budgetStats.InFlight).
+			Int("factor", budgetStats.Factor).
+			Dur("latency", budgetStats.Latency).
+			Float64("errorRate", budgetStats.ErrorRate).
+			Msg("Origin budget")
+		for _, member := range a.OriginPoolStats() {
+			a.log.Debug().
+				Str("member", member.Address).
+				Bool("available", member.Available).
+				Bool("healthy", member.Healthy).
+				Int("active", member.Active).
+				Int("failures", member.Failures).
+				Int64("requests", member.Requests).
+				Int64("errors", member.Errors).
+				Msg("Origin pool member")
+		}
+	}
+}
+
+// scheduleUpdate queues the stored entry for updating, if updates are enabled.
+func (a *AlwaysCache) scheduleUpdate(ce cache.CacheEntry) {
+	if a.updater == nil {
+		return
+	}
+	for _, method := range replayableMethods {
+		if strings.HasPrefix(ce.Key, a.keyer.MethodPrefix(method)) {
+			a.updater.Schedule(ce.Key, ce.ReceivedAt, ce.Expires)
+			return
 		}
 	}
 }
 
+// updateScheduled is called by the update workers when an entry is due for updating.
+func (a *AlwaysCache) updateScheduled(key string) {
+	// the entry might have been purged after it was scheduled
+	if !a.cache.Has(key) {
+		return
+	}
+	if a.isIdle(key) {
+		a.skipIdle(key)
+		return
+	}
+	a.updateEntry(key)
+}
+
+// UpdateQueueStats returns the state of the update queue.
+// The stats are empty if updates are disabled.
+func (a *AlwaysCache) UpdateQueueStats() scheduler.Stats {
+	if a.updater == nil {
+		return scheduler.Stats{}
+	}
+	return a.updater.Stats()
+}
+
 func (a *AlwaysCache) updateAll() {
 	a.cache.AllKeys(a.keyer.OriginPrefix, func(key string) {
 		a.updateEntry(key)
 	})
 }
 
-// updateKey will update the stored response identified by the given key.
+// updateEntry will update the stored response identified by the given key.
 // It is assumed that the key exists in the cache, if not (and the key is still valid),
 // a new entry identified by the key is created.
-// If there is an error while updating, the key will be purged from the cache.
+// If the origin fails transiently, the update is retried later and the stored response is kept.
+// The key is purged only if the origin gives an authoritative answer that the response
+// is gone or not cacheable.
 func (a *AlwaysCache) updateEntry(key string) {
-	var (
-		err    error
-		cached bool
-	)
-	// log error by default (see below)
-	logError := true
-
-	// get request based on key and save response to cache
-	var req *http.Request
-	if req, err = a.keyer.GetRequestFromKey(key); err == cachekey.ErrorMethodNotSupported {
-		logError = false
-	} else if err == nil {
-		a.log.Trace().Str("key", key).Str("req.path", req.URL.Path).Msg("Updating cache")
-		cached, err = a.saveRequest(req, key)
-		// if there was an error, sleep and retry
-		if !cached || err != nil {
-			time.Sleep(time.Second)
-			cached, err = a.saveRequest(req, key)
-		}
-	}
-
-	// log error if not explicitly disabled
-	if err != nil && logError {
+	req, err := a.requestFromKey(key)
+	if err != nil {
+		if err != cachekey.ErrorMethodNotSupported {
+			a.log.Error().Err(err).Str("key", key).Msg("Could not update cache entry")
+		}
+		a.cache.Purge(key)
+		return
+	}
+
+	// the origin is not contacted while offline, the stored response is kept until it is back
+	if a.offline.active() {
+		if a.updater != nil {
+			a.updater.ScheduleAt(key, time.Now().Add(a.offline.config.ProbeInterval))
+		}
+		return
+	}
+
+	rw := a.refreshEntry(key, req)
+	// transient failures must not overwrite the stored response
+	if isTransientFailure(rw.StatusCode()) {
+		a.retryUpdate(key, rw)
+		return
+	}
+	a.retries.succeeded(key)
+}
+
+// refreshEntry fetches the response for the given key with the given request and stores it.
+// The stored response is validated with a conditional request if possible, and freshened
+// if it has not been modified. It is purged if the origin says that it is gone or not cacheable.
+// Transient failures are not stored, the caller decides whether and when to retry.
+func (a *AlwaysCache) refreshEntry(key string, req *http.Request) *tee.ResponseSaver {
+	// validate the stored response instead of fetching a full response, if possible
+	ce, found := a.getEntry(key)
+	if found && req.Method == http.MethodGet {
+		if validationReq := a.validationRequest(ce); validationReq != nil {
+			req = validationReq
+		}
+	}
+
+	a.log.Trace().Str("key", key).Str("req.path", req.URL.Path).Msg("Updating cache")
+	rw := a.fetch(req, key)
+	if isTransientFailure(rw.StatusCode()) {
+		return rw
+	}
+	if found && rw.StatusCode() == http.StatusNotModified {
+		if err := a.freshenEntry(ce, rw, req); err != nil {
+			a.log.Error().Err(err).Str("key", key).Msg("Could not freshen cache entry")
+		}
+		return rw
+	}
+	if isGone(rw.StatusCode()) {
+		a.log.Debug().Str("key", key).Int("status", rw.StatusCode()).Msg("Purging entry gone from origin")
+		a.cache.Purge(key)
+		return rw
+	}
+	if cached, err := a.writeCache(rw, req); err != nil {
 		a.log.Error().Err(err).Str("key", key).Msg("Could not update cache entry")
+	} else if !cached {
+		a.log.Debug().Str("key", key).Int("status", rw.StatusCode()).Msg("Purging entry not cacheable anymore")
+		a.cache.Purge(key)
 	}
-	// if there was an error, it should most definitely be purged
-	// if the response was not cached, it means it should be purged
-	if err != nil || !cached {
+	return rw
+}
+
+// retryUpdate schedules a new update attempt after a transient failure, with exponential backoff.
+// The stored response is kept until it has been stale for longer than the maximum staleness.
+func (a *AlwaysCache) retryUpdate(key string, rw *tee.ResponseSaver) {
+	attempt := a.retries.failed(key)
+	ce, found := a.getEntry(key)
+	if !found {
+		a.retries.succeeded(key)
+		return
+	}
+	if time.Since(ce.Expires) > a.maxStaleness && !a.offline.active() {
+		a.log.Warn().
+			Str("key", key).
+			Int("status", rw.StatusCode()).
+			Int("attempt", attempt).
+			Msg("Could not update cache entry, purging after maximum staleness")
+		a.retries.succeeded(key)
 		a.cache.Purge(key)
+		return
+	}
+	if a.updater == nil {
+		return
+	}
+	delay := retryDelay(attempt, rw.Header().Get("Retry-After"))
+	a.log.Warn().
+		Str("key", key).
+		Int("status", rw.StatusCode()).
+		Int("attempt", attempt).
+		Dur("retryIn", delay).
+		Msg("Could not update cache entry, retrying")
+	a.updater.ScheduleAt(key, time.Now().Add(delay))
+}
+
+// validationRequest returns a conditional request for validating the stored entry,
+// or nil if the stored response does not have any validators.
+func (a *AlwaysCache) validationRequest(ce cache.CacheEntry) *http.Request {
+	res := a.createStoredResponse(ce)
+	if res == nil {
+		return nil
+	}
+	defer res.Body.Close()
+	if res.Header.Get("ETag") == "" && res.Header.Get("Last-Modified") == "" {
+		return nil
+	}
+	req, err := rfc9111.ValidationRequest(res)
+	if err != nil {
+		a.log.Error().Err(err).Str("key", ce.Key).Msg("Could not create validation request")
+		return nil
+	}
+	// the cache key partition is needed in order to store the response under the same key
+	if ck := res.Request.Header.Get("Cache-Key"); ck != "" {
+		req.Header.Set("Cache-Key", ck)
+	}
+	return req
+}
+
+// freshenEntry updates the headers and expiration of the stored entry based on
+// a 304 (Not Modified) response, keeping the stored body.
+func (a *AlwaysCache) freshenEntry(ce cache.CacheEntry, notModified *tee.ResponseSaver, req *http.Request) error {
+	previousHeader, err := headerSection(ce.Bytes)
+	if err != nil {
+		return err
+	}
+	res := a.createStoredResponse(ce)
+	if res == nil {
+		return fmt.Errorf("Could not create stored response")
+	}
+	res.Body.Close()
+	rfc9111.FreshenStoredResponse(res, &http.Response{Header: notModified.Header()})
+
+	// the header section is serialized like that of responses stored by writeCache
+	rw := tee.NewResponseSaver(nil)
+	for name, values := range res.Header {
+		rw.Header()[name] = values
 	}
+	rw.WriteHeader(res.StatusCode)
+	freshened := cache.CacheEntry{
+		Key:         ce.Key,
+		Expires:     rfc9111.GetExpiration(&http.Response{Header: res.Header, StatusCode: res.StatusCode, Request: req}),
+		RequestedAt: notModified.CreatedAt,
+		ReceivedAt:  time.Now(),
+		Bytes:       rw.Response(),
+	}
+	refresh := freshened
+	if stats, found, err := a.cache.KeyStats(ce.Key); err == nil && found {
+		refresh.Expires = a.adaptiveExpiry(freshened, res, stats.Changes)
+		if refresh.Expires.After(freshened.Expires) {
+			freshened.Expires = refresh.Expires
+		}
+	}
+
+	a.log.Trace().Str("key", ce.Key).Msg("Freshening cache entry")
+	if updated, err := a.cache.UpdateHeader(freshened, previousHeader); err != nil {
+		return err
+	} else if updated {
+		a.scheduleUpdate(refresh)
+	}
+	return nil
+}
+
+// headerSection returns the status line and header fields of the stored response bytes,
+// including the empty line ending them.
+func headerSection(b []byte) ([]byte, error) {
+	r := bytes.NewReader(b)
+	br := bufio.NewReader(r)
+	tp := textproto.NewReader(br)
+	if _, err := tp.ReadLine(); err != nil {
+		return nil, err
+	}
+	if _, err := tp.ReadMIMEHeader(); err != nil {
+		return nil, err
+	}
+	return b[:len(b)-r.Len()-br.Buffered()], nil
+}
+
+// getEntry returns the stored entry with exactly the given key.
+func (a *AlwaysCache) getEntry(key string) (cache.CacheEntry, bool) {
+	entries, err := a.cache.All(key)
+	if err != nil {
+		a.log.Error().Err(err).Str("key", key).Msg("Could not retrieve from cache")
+		return cache.CacheEntry{}, false
+	}
+	for _, ce := range entries {
+		if ce.Key == key {
+			return ce, true
+		}
+	}
+	return cache.CacheEntry{}, false
 }
 
 func (a *AlwaysCache) saveRequest(req *http.Request, key string) (bool, error) {
+	return a.writeCache(a.fetch(req, key), req)
+}
+
+// fetch sends the request to the origin and returns the recorded response.
+func (a *AlwaysCache) fetch(req *http.Request, key string) *tee.ResponseSaver {
 	a.log.Debug().
 		Str("method", req.Method).
 		Str("url", req.URL.String()).
@@ -125,10 +420,11 @@ func (a *AlwaysCache) saveRequest(req *http.Request, key string) (bool, error) {
 		Msg("Requesting content from origin")
 
 	rw := tee.NewResponseSaver(nil)
-	a.reverseproxy.ServeHTTP(rw, req)
-
-	return a.writeCache(rw, req)
+	a.roundTrip(a.budget.Background(), rw, req)
+	return rw
 }
+
+// revalidateUris updates all stored variants of the given URIs.
 func (a *AlwaysCache) revalidateUris(uris []string) {
 	for _, uri := range uris {
 		a.log.Trace().Str("uri", uri).Msgf("Revalidating possibly stored response")
@@ -137,16 +433,13 @@ func (a *AlwaysCache) revalidateUris(uris []string) {
 			a.log.Error().Err(err).Str("uri", uri).Msg("Could not create request for revalidation")
 			continue
 		}
-		key := a.keyer.GetKeyPrefix(req)
-		if a.cache.Has(key) {
-			_, err := a.saveRequest(req, key)
-			if err != nil {
-				a.log.Error().Err(err).Str("key", key).Msg("Error revalidating stored request")
-			}
+		for _, key := range a.variantKeys(req) {
+			a.updateEntry(key)
 		}
 	}
 }
 
+// invalidateUris purges all stored variants of the given URIs.
 func (a *AlwaysCache) invalidateUris(uris []string) {
 	for _, uri := range uris {
 		a.log.Trace().Str("uri", uri).Msgf("Invalidating stored response")
@@ -155,6 +448,27 @@ func (a *AlwaysCache) invalidateUris(uris []string) {
 			a.log.Error().Err(err).Str("uri", uri).Msg("Could not create request for invalidation")
 			continue
 		}
-		a.cache.Purge(a.keyer.GetKeyPrefix(req))
+		a.purgePrefix(a.keyer.GetKeyPrefix(req))
 	}
 }
+
+// postKeys returns the keys of all stored POST responses for the given URI, whatever the request body.
+func (a *AlwaysCache) postKeys(uri string) []string {
+	keys := make([]string, 0)
+	for _, prefix := range a.keyer.URIPrefixes(http.MethodPost, uri) {
+		a.cache.AllKeys(prefix, func(key string) {
+			keys = append(keys, key)
+		})
+	}
+	return keys
+}
+
+// variantKeys returns the keys of all stored responses for the URI of the given request,
+// i.e. all Vary variants and `Cache-Key` partitions.
+func (a *AlwaysCache) variantKeys(req *http.Request) []string {
+	keys := make([]string, 0)
+	a.cache.AllKeys(a.keyer.GetKeyPrefix(req), func(key string) {
+		keys = append(keys, key)
+	})
+	return keys
+}
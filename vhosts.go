@@ -0,0 +1,120 @@
+package alwayscache
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/always-cache/always-cache/cache"
+
+	"github.com/rs/zerolog"
+)
+
+type VirtualHostsConfig struct {
+	// Storage shared by the cache entries of all origins.
+	Cache cache.CacheProvider
+	// Origin configurations by host name (without port), e.g. `www.example.com`.
+	// The Cache of each configuration is set to the shared storage.
+	// The host name is used as the origin identifier in cache keys if OriginId is not set.
+	Hosts map[string]Config
+	// Reject TLS requests whose server name (SNI) differs from the `Host` header.
+	// Requests without a `Host` header are routed by the server name regardless.
+	StrictSNI bool
+	// Logger to use. The global zerolog logger is used if nil.
+	Logger *zerolog.Logger
+}
+
+// VirtualHosts routes requests by host to the always-cache instance of the origin configured for it,
+// so that a single process can serve many origins from the same storage.
+// Each origin has its own cache keys, updater, transport and policy.
+type VirtualHosts struct {
+	hosts     map[string]*AlwaysCache
+	cache     cache.CacheProvider
+	strictSNI bool
+	log       zerolog.Logger
+}
+
+// CreateVirtualHosts initializes an always-cache instance for each configured host.
+func CreateVirtualHosts(config VirtualHostsConfig) (*VirtualHosts, error) {
+	var logger zerolog.Logger
+	if config.Logger == nil {
+		logger = zerolog.New(zerolog.NewConsoleWriter())
+	} else {
+		logger = *config.Logger
+	}
+
+	v := &VirtualHosts{
+		hosts:     make(map[string]*AlwaysCache, len(config.Hosts)),
+		cache:     config.Cache,
+		strictSNI: config.StrictSNI,
+		log:       logger,
+	}
+	originIds := make(map[string]string, len(config.Hosts))
+	for host, hostConfig := range config.Hosts {
+		host = normalizeHost(host)
+		if _, found := v.hosts[host]; found {
+			return nil, fmt.Errorf("Host configured more than once: %s", host)
+		}
+		if hostConfig.OriginId == "" {
+			hostConfig.OriginId = host
+		}
+		if other, found := originIds[hostConfig.OriginId]; found {
+			return nil, fmt.Errorf("Hosts %s and %s have the same origin identifier", other, host)
+		}
+		originIds[hostConfig.OriginId] = host
+		hostConfig.Cache = config.Cache
+		if hostConfig.Logger == nil {
+			hostLogger := logger.With().Str("host", host).Logger()
+			hostConfig.Logger = &hostLogger
+		}
+		v.hosts[host] = CreateCache(hostConfig)
+	}
+	return v, nil
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (v *VirtualHosts) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := normalizeHost(r.Host)
+	if r.TLS != nil && r.TLS.ServerName != "" {
+		serverName := normalizeHost(r.TLS.ServerName)
+		if host == "" {
+			host = serverName
+		} else if v.strictSNI && host != serverName {
+			v.log.Warn().Str("host", host).Str("sni", serverName).Msg("Host does not match server name")
+			http.Error(w, "Misdirected Request", http.StatusMisdirectedRequest)
+			return
+		}
+	}
+	a, found := v.hosts[host]
+	if !found {
+		v.log.Warn().Str("host", host).Str("url", r.URL.String()).Msg("Request for unknown host")
+		http.Error(w, "Misdirected Request", http.StatusMisdirectedRequest)
+		return
+	}
+	a.ServeHTTP(w, r)
+}
+
+// Host returns the always-cache instance of the given host, if configured.
+func (v *VirtualHosts) Host(host string) (*AlwaysCache, bool) {
+	a, found := v.hosts[normalizeHost(host)]
+	return a, found
+}
+
+// Close stops the always-cache instances of all hosts and closes the shared cache storage.
+func (v *VirtualHosts) Close() {
+	for _, a := range v.hosts {
+		a.stop()
+	}
+	if err := v.cache.Close(); err != nil {
+		v.log.Error().Err(err).Msg("Could not close cache")
+	}
+}
+
+// normalizeHost returns the lower-case host name without port and trailing dot.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
@@ -0,0 +1,58 @@
+package alwayscache
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/always-cache/always-cache/cache"
+)
+
+func TestVirtualHosts(t *testing.T) {
+	hosts := map[string]Config{}
+	for i, name := range []string{"a.example", "b.example"} {
+		name := name
+		port := 9020 + i
+		mux := http.NewServeMux()
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Cache-Control", "max-age=60")
+			w.Write([]byte(name))
+		})
+		server := http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}
+		go server.ListenAndServe()
+		defer server.Shutdown(context.Background())
+		originURL, _ := url.Parse(fmt.Sprintf("http://localhost:%d", port))
+		hosts[name] = Config{OriginURL: *originURL}
+	}
+	v, err := CreateVirtualHosts(VirtualHostsConfig{Cache: cache.NewSQLiteCache(""), Hosts: hosts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 200)
+
+	get := func(host string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/page", nil)
+		req.Host = host
+		rr := httptest.NewRecorder()
+		v.ServeHTTP(rr, req)
+		time.Sleep(time.Millisecond * 100)
+		return rr
+	}
+	for _, host := range []string{"a.example", "B.example:8080", "a.example", "b.example"} {
+		rr := get(host)
+		if expected := normalizeHost(host); rr.Body.String() != expected {
+			t.Fatalf("Body for %s is %s", host, rr.Body.String())
+		}
+	}
+	if rr := get("a.example"); !strings.Contains(rr.Header().Get("Cache-Status"), "hit") {
+		t.Fatalf("Cache-Status is %s", rr.Header().Get("Cache-Status"))
+	}
+	if rr := get("unknown.example"); rr.Code != http.StatusMisdirectedRequest {
+		t.Fatalf("Status for unknown host is %d", rr.Code)
+	}
+}